@@ -0,0 +1,249 @@
+// Copyright (c) 2023 Adam Prakash Stringer
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted (subject to the limitations in the disclaimer
+// below) provided that the following conditions are met:
+//
+//     * Redistributions of source code must retain the above copyright notice,
+//     this list of conditions and the following disclaimer.
+//
+//     * Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+//     * Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from this
+//     software without specific prior written permission.
+//
+// NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+// THIS LICENSE. THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR
+// BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER
+// IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package kvs
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sync"
+)
+
+// Codec encodes and decodes field values which are not strings, []byte or UUIDs,
+// those are always stored as they are. The codec's Encoding is written as each
+// entry's meta byte, which is how an entry finds its codec again when it is read.
+type Codec interface {
+	Encoding() Encoding
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[Encoding]Codec{
+		JSONEncoding:    JSONCodec{},
+		OrderedEncoding: OrderedCodec{},
+		GobEncoding:     GobCodec{},
+		BinaryEncoding:  BinaryCodec{},
+	}
+)
+
+// FirstCustomEncoding is the lowest encoding a custom codec can use, those
+// below it are reserved for the built in codecs.
+const FirstCustomEncoding Encoding = 16
+
+// RegisterCodec makes a custom codec available for reading entries written with
+// its encoding. Encodings below FirstCustomEncoding are reserved for the built
+// in codecs, so custom codecs should pick a value from 16 to 127.
+func RegisterCodec(c Codec) error {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+
+	enc := c.Encoding()
+	if existing, ok := codecs[enc]; ok {
+		if reflect.TypeOf(existing) != reflect.TypeOf(c) {
+			return fmt.Errorf("encoding %d is already registered to %T", enc, existing)
+		}
+		return nil
+	}
+	if enc < FirstCustomEncoding {
+		return fmt.Errorf("encoding %d is reserved for built in codecs", enc)
+	}
+	codecs[enc] = c
+	return nil
+}
+
+// unregisterCodec drops the codec registered for enc, so tests can undo their
+// registrations.
+func unregisterCodec(enc Encoding) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	delete(codecs, enc)
+}
+
+// CheckCodec returns an error unless c is the codec registered for its
+// encoding, as entries written with any other codec can't be read back.
+func CheckCodec(c Codec) error {
+	registered, err := CodecFor(c.Encoding())
+	if err != nil {
+		return err
+	}
+	if reflect.TypeOf(registered) != reflect.TypeOf(c) {
+		return fmt.Errorf("encoding %d is registered to %T, not %T", c.Encoding(), registered, c)
+	}
+	return nil
+}
+
+func CodecFor(enc Encoding) (Codec, error) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+
+	c, ok := codecs[enc]
+	if !ok {
+		return nil, fmt.Errorf("no codec registered for encoding %d", enc)
+	}
+	return c, nil
+}
+
+// EncodeValue encodes v the way a field holding it would be stored with codec c,
+// the returned meta byte has to be stored alongside it for it to be decoded.
+func EncodeValue(v any, c Codec) ([]byte, byte, error) {
+	if c == nil {
+		c = JSONCodec{}
+	}
+	data, err := convertToBytesWithCodec(v, c)
+	return data, byte(c.Encoding()), err
+}
+
+type JSONCodec struct{}
+
+func (JSONCodec) Encoding() Encoding                 { return JSONEncoding }
+func (JSONCodec) Marshal(v any) ([]byte, error)      { return json.Marshal(v) }
+func (JSONCodec) Unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
+
+// OrderedCodec writes values with OrderedEncoding.
+type OrderedCodec struct{}
+
+func (OrderedCodec) Encoding() Encoding                 { return OrderedEncoding }
+func (OrderedCodec) Marshal(v any) ([]byte, error)      { return EncodeOrdered(v) }
+func (OrderedCodec) Unmarshal(data []byte, v any) error { return decodeOrdered(data, v) }
+
+type GobCodec struct{}
+
+func (GobCodec) Encoding() Encoding { return GobEncoding }
+
+func (GobCodec) Marshal(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (GobCodec) Unmarshal(data []byte, v any) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// BinaryCodec writes bools as a single byte, integers as varints and floats
+// as their IEEE 754 bits. Values implementing encoding.BinaryMarshaler, such
+// as time.Time, use that and anything else falls back to JSON.
+type BinaryCodec struct{}
+
+func (BinaryCodec) Encoding() Encoding { return BinaryEncoding }
+
+func (BinaryCodec) Marshal(i any) ([]byte, error) {
+	if m, ok := i.(encoding.BinaryMarshaler); ok {
+		return m.MarshalBinary()
+	}
+
+	v := reflect.ValueOf(i)
+	if !v.IsValid() {
+		return json.Marshal(i)
+	}
+
+	switch k := v.Kind(); {
+	case k == reflect.Bool:
+		if v.Bool() {
+			return []byte{1}, nil
+		}
+		return []byte{0}, nil
+	case isSigned(k):
+		return binary.AppendVarint(nil, v.Int()), nil
+	case isUnsigned(k):
+		return binary.AppendUvarint(nil, v.Uint()), nil
+	case k == reflect.Float32:
+		return binary.BigEndian.AppendUint32(nil, math.Float32bits(float32(v.Float()))), nil
+	case k == reflect.Float64:
+		return binary.BigEndian.AppendUint64(nil, math.Float64bits(v.Float())), nil
+	case k == reflect.String:
+		return []byte(v.String()), nil
+	}
+
+	return json.Marshal(i)
+}
+
+func (BinaryCodec) Unmarshal(data []byte, i any) error {
+	if u, ok := i.(encoding.BinaryUnmarshaler); ok {
+		return u.UnmarshalBinary(data)
+	}
+
+	v := reflect.ValueOf(i)
+	if v.Kind() != reflect.Pointer || v.IsNil() {
+		return fmt.Errorf("destination must be a pointer")
+	}
+	v = v.Elem()
+
+	switch k := v.Kind(); {
+	case k == reflect.Bool:
+		if len(data) != 1 {
+			return fmt.Errorf("binary bool must be 1 byte, got %d", len(data))
+		}
+		v.SetBool(data[0] == 1)
+		return nil
+	case isSigned(k):
+		n, read := binary.Varint(data)
+		if read <= 0 || read != len(data) {
+			return fmt.Errorf("malformed binary varint")
+		}
+		v.SetInt(n)
+		return nil
+	case isUnsigned(k):
+		n, read := binary.Uvarint(data)
+		if read <= 0 || read != len(data) {
+			return fmt.Errorf("malformed binary uvarint")
+		}
+		v.SetUint(n)
+		return nil
+	case k == reflect.Float32:
+		if len(data) != 4 {
+			return fmt.Errorf("binary float32 must be 4 bytes, got %d", len(data))
+		}
+		v.SetFloat(float64(math.Float32frombits(binary.BigEndian.Uint32(data))))
+		return nil
+	case k == reflect.Float64:
+		if len(data) != 8 {
+			return fmt.Errorf("binary float64 must be 8 bytes, got %d", len(data))
+		}
+		v.SetFloat(math.Float64frombits(binary.BigEndian.Uint64(data)))
+		return nil
+	case k == reflect.String:
+		v.SetString(string(data))
+		return nil
+	}
+
+	return json.Unmarshal(data, i)
+}
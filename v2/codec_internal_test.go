@@ -0,0 +1,141 @@
+// Copyright (c) 2023 Adam Prakash Stringer
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted (subject to the limitations in the disclaimer
+// below) provided that the following conditions are met:
+//
+//     * Redistributions of source code must retain the above copyright notice,
+//     this list of conditions and the following disclaimer.
+//
+//     * Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+//     * Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from this
+//     software without specific prior written permission.
+//
+// NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+// THIS LICENSE. THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR
+// BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER
+// IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package kvs
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+func TestBuiltInCodecsRoundTrip(t *testing.T) {
+	is := is.New(t)
+
+	type TestStruct struct {
+		A int
+		B string
+	}
+
+	now := time.Date(2023, 5, 17, 10, 30, 0, 1234, time.UTC)
+	inputs := []any{true, -42, int16(300), uint64(1 << 40), float32(3.25), -2.5, now, TestStruct{A: 5, B: "hello"}, []int{1, 2, 3}}
+
+	for _, c := range []Codec{JSONCodec{}, OrderedCodec{}, GobCodec{}, BinaryCodec{}} {
+		for _, input := range inputs {
+			encoded, err := convertToBytesWithCodec(input, c)
+			is.NoErr(err)
+
+			dest := reflect.New(reflect.TypeOf(input))
+			is.NoErr(convertFromBytesWithEncoding(encoded, dest.Interface(), c.Encoding()))
+			is.Equal(dest.Elem().Interface(), input)
+		}
+	}
+}
+
+func TestBinaryCodecIsCompact(t *testing.T) {
+	is := is.New(t)
+
+	encoded, err := BinaryCodec{}.Marshal(-3)
+	is.NoErr(err)
+	is.Equal(len(encoded), 1)
+
+	encoded, err = BinaryCodec{}.Marshal(uint32(100000))
+	is.NoErr(err)
+	is.Equal(len(encoded), 3)
+}
+
+type reversingCodec struct{}
+
+func (reversingCodec) Encoding() Encoding { return Encoding(42) }
+
+func (reversingCodec) Marshal(v any) ([]byte, error) {
+	b, err := JSONCodec{}.Marshal(v)
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+	return b, err
+}
+
+func (reversingCodec) Unmarshal(data []byte, v any) error {
+	b := append([]byte{}, data...)
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+	return JSONCodec{}.Unmarshal(b, v)
+}
+
+func TestRegisterCustomCodec(t *testing.T) {
+	is := is.New(t)
+
+	var dest int
+	is.True(convertFromBytesWithEncoding([]byte("21"), &dest, Encoding(42)) != nil) // unregistered encodings can't be read
+
+	is.NoErr(RegisterCodec(reversingCodec{}))
+	t.Cleanup(func() { unregisterCodec(reversingCodec{}.Encoding()) })
+	is.NoErr(convertFromBytesWithEncoding([]byte("21"), &dest, Encoding(42)))
+	is.Equal(dest, 12)
+	is.Equal(Encoding(42).String(), "kvs.reversingCodec")
+
+	is.True(RegisterCodec(overlappingCodec{}) != nil) // encodings can't be claimed twice
+	is.NoErr(RegisterCodec(reversingCodec{}))         // registering the same codec again is fine
+	is.NoErr(RegisterCodec(GobCodec{}))
+}
+
+type overlappingCodec struct{ JSONCodec }
+
+func (overlappingCodec) Encoding() Encoding { return GobEncoding }
+
+type reservedCodec struct {
+	JSONCodec
+	enc Encoding
+}
+
+func (c reservedCodec) Encoding() Encoding { return c.enc }
+
+func TestRegisterCodecRejectsReservedEncodings(t *testing.T) {
+	is := is.New(t)
+
+	is.True(RegisterCodec(reservedCodec{enc: 4}) != nil)
+	is.True(RegisterCodec(reservedCodec{enc: ExpandedEncoding}) != nil)
+
+	_, err := CodecFor(ExpandedEncoding)
+	is.True(err != nil) // the expanded header encoding has no codec
+}
+
+func TestCheckCodecRequiresRegistration(t *testing.T) {
+	is := is.New(t)
+
+	is.NoErr(CheckCodec(OrderedCodec{}))
+	is.True(CheckCodec(reservedCodec{enc: 99}) != nil)
+	is.True(CheckCodec(overlappingCodec{}) != nil) // gob's encoding belongs to GobCodec
+}
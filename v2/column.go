@@ -0,0 +1,224 @@
+// Copyright (c) 2023 Adam Prakash Stringer
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted (subject to the limitations in the disclaimer
+// below) provided that the following conditions are met:
+//
+//     * Redistributions of source code must retain the above copyright notice,
+//     this list of conditions and the following disclaimer.
+//
+//     * Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+//     * Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from this
+//     software without specific prior written permission.
+//
+// NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+// THIS LICENSE. THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR
+// BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER
+// IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package kvs
+
+import (
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// Column describes a struct field which is stored as its own entry.
+type Column struct {
+	// Name is the lower cased field name. Fields of nested and embedded
+	// structs are flattened into their own columns, named by the path to
+	// them, for example "address.city" or "audit.createdby" for an
+	// embedded Audit struct.
+	Name  string
+	Type  reflect.Type
+	Index bool
+	// Unique columns may only hold a value once per owner, or once
+	// across every owner of the table when UniqueGlobal is also set.
+	Unique       bool
+	UniqueGlobal bool
+	// Expand is set for slice and map columns tagged mdb:"expand", which
+	// store each element as its own entry. They can't be indexed.
+	Expand bool
+	// Version is set for integer columns tagged mdb:"version", which the
+	// store increments with every write of the row.
+	Version bool
+}
+
+type columnField struct {
+	Column
+	index []int
+}
+
+var columnFieldsCache sync.Map
+
+// Columns lists the stored columns of x, in field order, skipping ignored fields.
+func Columns(x any) []Column {
+	fields := resolveColumnFields(reflect.TypeOf(x))
+	columns := make([]Column, 0, len(fields))
+	for _, f := range fields {
+		columns = append(columns, f.Column)
+	}
+	return columns
+}
+
+func resolveColumnFields(t reflect.Type) []columnField {
+	if t == nil {
+		return nil
+	}
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+
+	if cached, ok := columnFieldsCache.Load(t); ok {
+		return cached.([]columnField)
+	}
+	fields := appendColumnFields(nil, t, "", nil)
+	columnFieldsCache.Store(t, fields)
+	return fields
+}
+
+func appendColumnFields(fields []columnField, t reflect.Type, prefix string, index []int) []columnField {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		fOpts := resolveFieldOptions(f)
+		if fOpts.Ignore {
+			continue
+		}
+
+		name := prefix + strings.ToLower(f.Name)
+		fieldIndex := append(append([]int{}, index...), i)
+
+		flatten := !fOpts.NoFlatten && flattenable(f.Type)
+		// like encoding/json, the exported fields of an unexported embedded struct are still stored
+		if !f.IsExported() && !(f.Anonymous && flatten) {
+			continue
+		}
+
+		if flatten {
+			fields = appendColumnFields(fields, f.Type, name+".", fieldIndex)
+			continue
+		}
+
+		expand := fOpts.Expand && (f.Type.Kind() == reflect.Slice || f.Type.Kind() == reflect.Map)
+		fields = append(fields, columnField{
+			Column: Column{
+				Name:         name,
+				Type:         f.Type,
+				Index:        fOpts.Index && !expand,
+				Unique:       fOpts.Unique && !expand,
+				UniqueGlobal: fOpts.Unique && fOpts.Global && !expand,
+				Expand:       expand,
+				Version:      fOpts.Version && (isSigned(f.Type.Kind()) || isUnsigned(f.Type.Kind())),
+			},
+			index: fieldIndex,
+		})
+	}
+	return fields
+}
+
+var (
+	jsonMarshalerType   = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshalerType   = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	binaryMarshalerType = reflect.TypeOf((*encoding.BinaryMarshaler)(nil)).Elem()
+)
+
+// flattenable reports whether a field of type t should be split into a column
+// per field. Structs which know how to marshal themselves, like time.Time, are
+// kept whole.
+func flattenable(t reflect.Type) bool {
+	if t.Kind() != reflect.Struct {
+		return false
+	}
+
+	for _, m := range []reflect.Type{jsonMarshalerType, textMarshalerType, binaryMarshalerType} {
+		if t.Implements(m) || reflect.PointerTo(t).Implements(m) {
+			return false
+		}
+	}
+
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).IsExported() {
+			return true
+		}
+	}
+	return false
+}
+
+// ColumnValue returns the current value of the field in x stored under columnName.
+func ColumnValue(x any, columnName string) (any, error) {
+	v := reflect.Indirect(reflect.ValueOf(x))
+	field, err := resolveFieldRef(v, columnName)
+	if err != nil {
+		return nil, err
+	}
+	return field.Interface(), nil
+}
+
+// SetColumnValue assigns value to the field in x stored under columnName, x
+// must be a pointer.
+func SetColumnValue(x any, columnName string, value any) error {
+	v := reflect.ValueOf(x)
+	if v.Kind() != reflect.Pointer {
+		return fmt.Errorf("destination must be a pointer")
+	}
+	field, err := resolveFieldRef(v.Elem(), columnName)
+	if err != nil {
+		return err
+	}
+
+	val := reflect.ValueOf(value)
+	if !val.IsValid() {
+		field.Set(reflect.Zero(field.Type()))
+		return nil
+	}
+	if !val.Type().AssignableTo(field.Type()) {
+		return fmt.Errorf("cannot assign %s to field %s of type %s", val.Type(), columnName, field.Type())
+	}
+	field.Set(val)
+	return nil
+}
+
+// ConvertLossless converts v to type t if that can be done without changing
+// its value, for example an untyped int literal into a uint8 field.
+func ConvertLossless(v any, t reflect.Type) (any, bool) {
+	vv := reflect.ValueOf(v)
+	if !vv.IsValid() {
+		return nil, false
+	}
+	if vv.Type() == t {
+		return v, true
+	}
+
+	if kindClass(vv.Kind()) != kindClass(t.Kind()) || kindClass(t.Kind()) == otherClass {
+		return nil, false
+	}
+	if !vv.Type().ConvertibleTo(t) {
+		return nil, false
+	}
+
+	converted := vv.Convert(t).Interface()
+	if c, err := CompareAny(converted, v); err != nil || c != 0 {
+		return nil, false
+	}
+	return converted, true
+}
@@ -0,0 +1,184 @@
+// Copyright (c) 2023 Adam Prakash Stringer
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted (subject to the limitations in the disclaimer
+// below) provided that the following conditions are met:
+//
+//     * Redistributions of source code must retain the above copyright notice,
+//     this list of conditions and the following disclaimer.
+//
+//     * Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+//     * Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from this
+//     software without specific prior written permission.
+//
+// NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+// THIS LICENSE. THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR
+// BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER
+// IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package kvs
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+)
+
+var ErrIncomparable = errors.New("values are not comparable")
+
+// CompareAny reports whether a sorts before (-1), the same as (0), or after (1) b.
+// Numbers of any width or signedness compare by value, so an int column may be
+// compared against a float64 literal. Strings, bools and time.Time values only
+// compare against their own kind, any other pairing returns ErrIncomparable.
+func CompareAny(a, b any) (int, error) {
+	av, bv := indirectValue(a), indirectValue(b)
+	if !av.IsValid() || !bv.IsValid() {
+		return 0, fmt.Errorf("%w: %T and %T", ErrIncomparable, a, b)
+	}
+
+	if at, ok := av.Interface().(time.Time); ok {
+		bt, ok := bv.Interface().(time.Time)
+		if !ok {
+			return 0, fmt.Errorf("%w: %T and %T", ErrIncomparable, a, b)
+		}
+		return compareTimes(at, bt), nil
+	}
+
+	ac, bc := kindClass(av.Kind()), kindClass(bv.Kind())
+	switch {
+	case ac == numericClass && bc == numericClass:
+		return compareNumbers(av, bv), nil
+	case ac == stringClass && bc == stringClass:
+		return compareOrdered(av.String(), bv.String()), nil
+	case ac == boolClass && bc == boolClass:
+		return compareBools(av.Bool(), bv.Bool()), nil
+	}
+
+	return 0, fmt.Errorf("%w: %T and %T", ErrIncomparable, a, b)
+}
+
+// DecodeBytes converts data, as stored by an entry with the given encoding, into a new value of type t.
+func DecodeBytes(data []byte, enc Encoding, t reflect.Type) (any, error) {
+	dest := reflect.New(t)
+	if err := convertFromBytesWithEncoding(data, dest.Interface(), enc); err != nil {
+		return nil, err
+	}
+	return dest.Elem().Interface(), nil
+}
+
+type valueClass int
+
+const (
+	otherClass valueClass = iota
+	numericClass
+	stringClass
+	boolClass
+)
+
+func kindClass(k reflect.Kind) valueClass {
+	switch k {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64:
+		return numericClass
+	case reflect.String:
+		return stringClass
+	case reflect.Bool:
+		return boolClass
+	}
+	return otherClass
+}
+
+func indirectValue(x any) reflect.Value {
+	v := reflect.ValueOf(x)
+	for v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			return reflect.Value{}
+		}
+		v = v.Elem()
+	}
+	return v
+}
+
+func isSigned(k reflect.Kind) bool {
+	return k >= reflect.Int && k <= reflect.Int64
+}
+
+func isUnsigned(k reflect.Kind) bool {
+	return k >= reflect.Uint && k <= reflect.Uintptr
+}
+
+func compareNumbers(a, b reflect.Value) int {
+	ak, bk := a.Kind(), b.Kind()
+	switch {
+	case isSigned(ak) && isSigned(bk):
+		return compareOrdered(a.Int(), b.Int())
+	case isUnsigned(ak) && isUnsigned(bk):
+		return compareOrdered(a.Uint(), b.Uint())
+	case isSigned(ak) && isUnsigned(bk):
+		if a.Int() < 0 {
+			return -1
+		}
+		return compareOrdered(uint64(a.Int()), b.Uint())
+	case isUnsigned(ak) && isSigned(bk):
+		if b.Int() < 0 {
+			return 1
+		}
+		return compareOrdered(a.Uint(), uint64(b.Int()))
+	}
+	return compareOrdered(toFloat(a), toFloat(b))
+}
+
+func toFloat(v reflect.Value) float64 {
+	switch {
+	case isSigned(v.Kind()):
+		return float64(v.Int())
+	case isUnsigned(v.Kind()):
+		return float64(v.Uint())
+	}
+	return v.Float()
+}
+
+func compareOrdered[N int64 | uint64 | float64 | string](a, b N) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func compareTimes(a, b time.Time) int {
+	switch {
+	case a.Before(b):
+		return -1
+	case a.After(b):
+		return 1
+	}
+	return 0
+}
+
+func compareBools(a, b bool) int {
+	switch {
+	case a == b:
+		return 0
+	case !a:
+		return -1
+	}
+	return 1
+}
@@ -0,0 +1,85 @@
+// Copyright (c) 2023 Adam Prakash Stringer
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted (subject to the limitations in the disclaimer
+// below) provided that the following conditions are met:
+//
+//     * Redistributions of source code must retain the above copyright notice,
+//     this list of conditions and the following disclaimer.
+//
+//     * Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+//     * Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from this
+//     software without specific prior written permission.
+//
+// NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+// THIS LICENSE. THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR
+// BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER
+// IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package kvs_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	"github.com/tauraamui/kvs/v2"
+)
+
+func TestCompareAnyOrdersMixedNumbers(t *testing.T) {
+	is := is.New(t)
+
+	tests := []struct {
+		a, b     any
+		expected int
+	}{
+		{1, 2, -1},
+		{int64(5), int8(5), 0},
+		{uint32(7), 3, 1},
+		{-1, uint(0), -1},
+		{uint64(10), -4, 1},
+		{2, 2.5, -1},
+		{float32(1.5), 1.5, 0},
+		{"apple", "banana", -1},
+		{true, false, 1},
+	}
+
+	for _, test := range tests {
+		c, err := kvs.CompareAny(test.a, test.b)
+		is.NoErr(err)
+		is.Equal(c, test.expected)
+	}
+}
+
+func TestCompareAnyOrdersTimes(t *testing.T) {
+	is := is.New(t)
+
+	now := time.Now()
+	c, err := kvs.CompareAny(now, now.Add(time.Second))
+	is.NoErr(err)
+	is.Equal(c, -1)
+}
+
+func TestCompareAnyMismatchedTypesReturnsError(t *testing.T) {
+	is := is.New(t)
+
+	_, err := kvs.CompareAny(5, "5")
+	is.True(errors.Is(err, kvs.ErrIncomparable))
+
+	_, err = kvs.CompareAny(time.Now(), 5)
+	is.True(errors.Is(err, kvs.ErrIncomparable))
+}
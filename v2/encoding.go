@@ -0,0 +1,253 @@
+// Copyright (c) 2023 Adam Prakash Stringer
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted (subject to the limitations in the disclaimer
+// below) provided that the following conditions are met:
+//
+//     * Redistributions of source code must retain the above copyright notice,
+//     this list of conditions and the following disclaimer.
+//
+//     * Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+//     * Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from this
+//     software without specific prior written permission.
+//
+// NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+// THIS LICENSE. THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR
+// BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER
+// IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package kvs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"time"
+)
+
+// Encoding identifies how an entry's data was written, it is stored as the
+// entry's meta byte so entries written with different encodings can live
+// side by side and still be read back.
+type Encoding byte
+
+const (
+	// JSONEncoding is the default and the encoding of all entries written
+	// before encodings were selectable.
+	JSONEncoding Encoding = iota
+	// OrderedEncoding writes bools, numbers and times as fixed width big
+	// endian values whose byte order matches their value order, so stored
+	// data can be compared without decoding it. Types it does not cover
+	// fall back to JSON.
+	OrderedEncoding
+	// GobEncoding writes values with encoding/gob.
+	GobEncoding
+	// BinaryEncoding writes bools and numbers as compact varints and
+	// falls back to JSON for everything else.
+	BinaryEncoding
+	// ExpandedEncoding marks the header entry of a slice or map column
+	// tagged with mdb:"expand", it holds no data of its own as each
+	// element is stored as a separate entry.
+	ExpandedEncoding Encoding = 15
+)
+
+func (enc Encoding) String() string {
+	switch enc {
+	case JSONEncoding:
+		return "json"
+	case OrderedEncoding:
+		return "ordered"
+	case GobEncoding:
+		return "gob"
+	case BinaryEncoding:
+		return "binary"
+	case ExpandedEncoding:
+		return "expanded"
+	default:
+		if c, err := CodecFor(enc); err == nil {
+			return fmt.Sprintf("%T", c)
+		}
+		return "unknown"
+	}
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+const signBit = uint64(1) << 63
+
+// EncodeOrdered encodes i with OrderedEncoding, regardless of how the column
+// it belongs to is stored. Strings are left as they are.
+func EncodeOrdered(i any) ([]byte, error) {
+	v := reflect.ValueOf(i)
+	if !v.IsValid() {
+		return json.Marshal(i)
+	}
+
+	if v.Type() == timeType {
+		t := v.Interface().(time.Time)
+		b := make([]byte, 12)
+		binary.BigEndian.PutUint64(b, uint64(t.Unix())^signBit)
+		binary.BigEndian.PutUint32(b[8:], uint32(t.Nanosecond()))
+		return b, nil
+	}
+
+	switch {
+	case v.Kind() == reflect.Bool:
+		if v.Bool() {
+			return []byte{1}, nil
+		}
+		return []byte{0}, nil
+	case isSigned(v.Kind()):
+		return putUint64(uint64(v.Int()) ^ signBit), nil
+	case isUnsigned(v.Kind()):
+		return putUint64(v.Uint()), nil
+	case v.Kind() == reflect.Float32 || v.Kind() == reflect.Float64:
+		f := v.Float()
+		if math.IsNaN(f) {
+			return nil, fmt.Errorf("unsupported value: %v", f)
+		}
+		if f == 0 {
+			// negative zero would otherwise sort below positive zero
+			f = 0
+		}
+		bits := math.Float64bits(f)
+		if bits&signBit != 0 {
+			bits = ^bits
+		} else {
+			bits |= signBit
+		}
+		return putUint64(bits), nil
+	case v.Kind() == reflect.String:
+		return []byte(v.String()), nil
+	}
+
+	return json.Marshal(i)
+}
+
+func decodeOrdered(data []byte, i any) error {
+	v := reflect.ValueOf(i)
+	if v.Kind() != reflect.Pointer || v.IsNil() {
+		return fmt.Errorf("destination must be a pointer")
+	}
+	v = v.Elem()
+
+	if v.Type() == timeType {
+		if len(data) != 12 {
+			return fmt.Errorf("ordered time must be 12 bytes, got %d", len(data))
+		}
+		secs := int64(binary.BigEndian.Uint64(data) ^ signBit)
+		nanos := int64(binary.BigEndian.Uint32(data[8:]))
+		v.Set(reflect.ValueOf(time.Unix(secs, nanos).UTC()))
+		return nil
+	}
+
+	switch {
+	case v.Kind() == reflect.Bool:
+		if len(data) != 1 {
+			return fmt.Errorf("ordered bool must be 1 byte, got %d", len(data))
+		}
+		v.SetBool(data[0] == 1)
+		return nil
+	case isSigned(v.Kind()):
+		u, err := getUint64(data)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(u ^ signBit))
+		return nil
+	case isUnsigned(v.Kind()):
+		u, err := getUint64(data)
+		if err != nil {
+			return err
+		}
+		v.SetUint(u)
+		return nil
+	case v.Kind() == reflect.Float32 || v.Kind() == reflect.Float64:
+		bits, err := getUint64(data)
+		if err != nil {
+			return err
+		}
+		if bits&signBit != 0 {
+			bits &^= signBit
+		} else {
+			bits = ^bits
+		}
+		v.SetFloat(math.Float64frombits(bits))
+		return nil
+	case v.Kind() == reflect.String:
+		v.SetString(string(data))
+		return nil
+	}
+
+	return json.Unmarshal(data, i)
+}
+
+// OrderedBytesComparable reports whether the ordered encoding of a value of
+// type a sorts against the ordered encoding of a value of type b byte for byte.
+func OrderedBytesComparable(a, b reflect.Type) bool {
+	if a == timeType || b == timeType {
+		return a == b
+	}
+	ak, bk := a.Kind(), b.Kind()
+	switch {
+	case isSigned(ak):
+		return isSigned(bk)
+	case isUnsigned(ak):
+		return isUnsigned(bk)
+	case ak == reflect.Float32 || ak == reflect.Float64:
+		return bk == reflect.Float32 || bk == reflect.Float64
+	case ak == reflect.String:
+		return bk == reflect.String
+	case ak == reflect.Bool:
+		return bk == reflect.Bool
+	}
+	return false
+}
+
+// CompareBytesToAnyOrdered reports whether data, stored with the given encoding
+// for a field of type fieldType, sorts before (-1), the same as (0) or after (1) v.
+// Data written with OrderedEncoding is compared byte for byte where v's type
+// allows it, everything else is decoded and compared with CompareAny.
+func CompareBytesToAnyOrdered(data []byte, enc Encoding, fieldType reflect.Type, v any) (int, error) {
+	if enc == OrderedEncoding && v != nil && OrderedBytesComparable(fieldType, reflect.TypeOf(v)) {
+		encoded, err := EncodeOrdered(v)
+		if err != nil {
+			return 0, err
+		}
+		return bytes.Compare(data, encoded), nil
+	}
+
+	stored, err := DecodeBytes(data, enc, fieldType)
+	if err != nil {
+		return 0, err
+	}
+	return CompareAny(stored, v)
+}
+
+func putUint64(u uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, u)
+	return b
+}
+
+func getUint64(data []byte) (uint64, error) {
+	if len(data) != 8 {
+		return 0, fmt.Errorf("ordered number must be 8 bytes, got %d", len(data))
+	}
+	return binary.BigEndian.Uint64(data), nil
+}
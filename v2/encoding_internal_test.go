@@ -0,0 +1,106 @@
+// Copyright (c) 2023 Adam Prakash Stringer
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted (subject to the limitations in the disclaimer
+// below) provided that the following conditions are met:
+//
+//     * Redistributions of source code must retain the above copyright notice,
+//     this list of conditions and the following disclaimer.
+//
+//     * Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+//     * Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from this
+//     software without specific prior written permission.
+//
+// NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+// THIS LICENSE. THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR
+// BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER
+// IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package kvs
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+func TestOrderedEncodingRoundTrips(t *testing.T) {
+	is := is.New(t)
+
+	now := time.Date(2023, 5, 17, 10, 30, 0, 1234, time.UTC)
+	tests := []any{true, false, -42, int8(-3), int64(1 << 40), uint16(7), uint64(1 << 63), -2.5, float32(3.25), 0.0, "hello", now}
+
+	for _, input := range tests {
+		encoded, err := convertToBytesWithCodec(input, OrderedCodec{})
+		is.NoErr(err)
+
+		dest := reflect.New(reflect.TypeOf(input))
+		is.NoErr(convertFromBytesWithEncoding(encoded, dest.Interface(), OrderedEncoding))
+		is.Equal(dest.Elem().Interface(), input)
+	}
+}
+
+func TestOrderedEncodingPreservesOrder(t *testing.T) {
+	is := is.New(t)
+
+	ordered := [][]any{
+		{-1000, -1, 0, 1, 250, 1 << 40},
+		{uint(0), uint(9), uint(300)},
+		{-1e9, -2.5, -0.5, 0.0, 0.25, 3.0, 1e12},
+		{time.Unix(-5, 0), time.Unix(0, 0), time.Unix(0, 10), time.Unix(100, 0)},
+	}
+
+	for _, values := range ordered {
+		for i := 1; i < len(values); i++ {
+			prev, err := EncodeOrdered(values[i-1])
+			is.NoErr(err)
+			next, err := EncodeOrdered(values[i])
+			is.NoErr(err)
+			is.Equal(bytes.Compare(prev, next), -1) // encoded values must sort in value order
+		}
+	}
+}
+
+func TestOrderedEncodingFallsBackToJSONForStructs(t *testing.T) {
+	is := is.New(t)
+
+	type TestStruct struct{ A int }
+	encoded, err := convertToBytesWithCodec(TestStruct{A: 5}, OrderedCodec{})
+	is.NoErr(err)
+	is.Equal(encoded, []byte("{\"A\":5}"))
+}
+
+func TestCompareBytesToAnyOrderedComparesEncodedBytes(t *testing.T) {
+	is := is.New(t)
+
+	encoded, err := EncodeOrdered(300)
+	is.NoErr(err)
+
+	c, err := CompareBytesToAnyOrdered(encoded, OrderedEncoding, reflect.TypeOf(0), int8(-4))
+	is.NoErr(err)
+	is.Equal(c, 1)
+
+	c, err = CompareBytesToAnyOrdered(encoded, OrderedEncoding, reflect.TypeOf(0), 300.5)
+	is.NoErr(err)
+	is.Equal(c, -1)
+
+	c, err = CompareBytesToAnyOrdered([]byte("300"), JSONEncoding, reflect.TypeOf(0), 300)
+	is.NoErr(err)
+	is.Equal(c, 0)
+}
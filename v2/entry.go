@@ -50,6 +50,9 @@ type Entry struct {
 	RowID      uint32
 	Data       []byte
 	Meta       byte
+	// ExpiresAt is the unix time the entry expires at, zero if it never
+	// does.
+	ExpiresAt uint64
 }
 
 func (e Entry) PrefixKey() []byte {
@@ -69,11 +72,23 @@ func (e Entry) resolveOwnerID() string {
 
 func Store(db KVDB, e Entry) error {
 	return db.conn.Update(func(txn *badger.Txn) error {
-		be := badger.NewEntry([]byte(e.Key()), e.Data)
-		return txn.SetEntry(be.WithMeta(e.Meta))
+		return StoreTxn(txn, e)
 	})
 }
 
+// StoreTxn writes the entry as part of the given transaction, leaving
+// commit or discard to the caller.
+func StoreTxn(txn *badger.Txn, e Entry) error {
+	be := badger.NewEntry([]byte(e.Key()), e.Data)
+	be.ExpiresAt = e.ExpiresAt
+	return txn.SetEntry(be.WithMeta(e.Meta))
+}
+
+// DeleteTxn removes the entry's key as part of the given transaction.
+func DeleteTxn(txn *badger.Txn, e Entry) error {
+	return txn.Delete(e.Key())
+}
+
 func Get(db KVDB, e *Entry) error {
 	return db.conn.View(func(txn *badger.Txn) error {
 		lookupKey := e.Key()
@@ -89,6 +104,7 @@ func Get(db KVDB, e *Entry) error {
 			return err
 		}
 		e.Meta = item.UserMeta()
+		e.ExpiresAt = item.ExpiresAt()
 
 		return nil
 	})
@@ -96,12 +112,46 @@ func Get(db KVDB, e *Entry) error {
 
 func ConvertToBlankEntries(tableName string, ownerID UUID, rowID uint32, x any) []Entry {
 	v := reflect.ValueOf(x)
-	return convertToEntries(tableName, ownerID, rowID, v, false)
+	// without data there is nothing to encode, so there is nothing that can fail
+	entries, _ := convertToEntries(tableName, ownerID, rowID, v, false, JSONCodec{})
+	return entries
+}
+
+// ConvertToLegacyEntries returns a blank entry for each top level struct field
+// of x which is flattened into columns of its own. Rows saved before structs
+// were flattened hold each of them whole under the field's name, LoadEntry
+// reads such an entry into every flattened field at once.
+func ConvertToLegacyEntries(tableName string, ownerID UUID, rowID uint32, x any) []Entry {
+	entries := []Entry{}
+	seen := map[string]bool{}
+	for _, f := range resolveColumnFields(reflect.TypeOf(x)) {
+		parent, _, nested := strings.Cut(f.Name, ".")
+		if !nested || seen[parent] {
+			continue
+		}
+		seen[parent] = true
+		entries = append(entries, Entry{TableName: tableName, ColumnName: parent, OwnerUUID: ownerID, RowID: rowID})
+	}
+	return entries
+}
+
+func ConvertToEntries(tableName string, ownerID UUID, rowID uint32, x any) ([]Entry, error) {
+	return ConvertToEntriesWithCodec(tableName, ownerID, rowID, x, JSONCodec{})
 }
 
-func ConvertToEntries(tableName string, ownerID UUID, rowID uint32, x any) []Entry {
+// ConvertToEntriesWithCodec is ConvertToEntries with the field values encoded
+// by the given codec, each entry's meta records the codec's encoding so the
+// entry can be decoded again later.
+func ConvertToEntriesWithCodec(tableName string, ownerID UUID, rowID uint32, x any, c Codec) ([]Entry, error) {
+	if c == nil {
+		c = JSONCodec{}
+	}
 	v := reflect.ValueOf(x)
-	return convertToEntries(tableName, ownerID, rowID, v, true)
+	entries, err := convertToEntries(tableName, ownerID, rowID, v, true, c)
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
 }
 
 type UUID interface {
@@ -113,6 +163,11 @@ type RootOwner struct{}
 func (o RootOwner) String() string { return "root" }
 
 func LoadEntry(s interface{}, entry Entry) error {
+	if Encoding(entry.Meta) == ExpandedEncoding {
+		// nothing to load from the header, the elements are loaded on their own
+		return nil
+	}
+
 	// convert the interface value to a reflect.Value so we can access its fields
 	val := reflect.ValueOf(s).Elem()
 
@@ -122,7 +177,7 @@ func LoadEntry(s interface{}, entry Entry) error {
 	}
 
 	// convert the entry's Data field to the type of the target field
-	if err := convertFromBytes(entry.Data, field.Addr().Interface()); err != nil {
+	if err := convertFromBytesWithEncoding(entry.Data, field.Addr().Interface(), Encoding(entry.Meta)); err != nil {
 		return fmt.Errorf("failed to convert entry data to field type: %v", err)
 	}
 
@@ -146,15 +201,44 @@ func LoadID(s any, rowID uint32) error {
 	return nil
 }
 
+// ColumnType returns the type of the field in x which is stored under columnName.
+func ColumnType(x any, columnName string) (reflect.Type, error) {
+	t := reflect.TypeOf(x)
+	if t == nil {
+		return nil, errors.New("cannot resolve column of nil value")
+	}
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("cannot resolve column of non struct type %s", t)
+	}
+
+	field, err := resolveFieldRef(reflect.New(t).Elem(), columnName)
+	if err != nil {
+		return nil, err
+	}
+	return field.Type(), nil
+}
+
 func resolveFieldRef(v reflect.Value, nameToMatch string) (reflect.Value, error) {
 	t := v.Type()
 
+	// flattened columns are named by the path to the field, so resolve
+	// each struct along the path in turn
+	name, nested, isNested := strings.Cut(nameToMatch, ".")
 	for i := 0; i < t.NumField(); i++ {
 		field := t.Field(i)
 
-		if strings.EqualFold(field.Name, nameToMatch) {
+		if !strings.EqualFold(field.Name, name) {
+			continue
+		}
+		if !isNested {
 			return v.Field(i), nil
 		}
+		if field.Type.Kind() == reflect.Struct {
+			return resolveFieldRef(v.Field(i), nested)
+		}
 	}
 
 	return reflect.Zero(reflect.TypeOf(v)), fmt.Errorf("struct does not have a field with name %q", nameToMatch)
@@ -170,40 +254,37 @@ func LoadEntries(s interface{}, entries []Entry) error {
 	return nil
 }
 
-func convertToEntries(tableName string, ownerUUID UUID, rowID uint32, v reflect.Value, includeData bool) []Entry {
+func convertToEntries(tableName string, ownerUUID UUID, rowID uint32, v reflect.Value, includeData bool, c Codec) ([]Entry, error) {
 	entries := []Entry{}
 
 	if v.Kind() == reflect.Pointer {
 		v = v.Elem()
 	}
-	for i := 0; i < v.NumField(); i++ {
-		vv := reflect.Indirect(v)
-		f := vv.Type().Field(i)
-
-		fOpts := resolveFieldOptions(f)
-		if fOpts.Ignore {
-			continue
-		}
-
+	for _, f := range resolveColumnFields(v.Type()) {
 		e := Entry{
 			TableName:  tableName,
-			ColumnName: strings.ToLower(f.Name),
+			ColumnName: f.Name,
 			OwnerUUID:  ownerUUID,
 			RowID:      rowID,
 		}
 
-		if includeData {
-			bd, err := convertToBytes(v.Field(i).Interface())
+		if includeData && f.Expand {
+			// expanded columns only store a header, their elements are
+			// stored as entries of their own
+			e.Meta = byte(ExpandedEncoding)
+		} else if includeData {
+			bd, err := convertToBytesWithCodec(v.FieldByIndex(f.index).Interface(), c)
 			if err != nil {
-				return entries
+				return nil, fmt.Errorf("failed to convert field %s to bytes: %w", f.Name, err)
 			}
 			e.Data = bd
+			e.Meta = byte(c.Encoding())
 		}
 
 		entries = append(entries, e)
 	}
 
-	return entries
+	return entries, nil
 }
 
 func convertToBytes(i interface{}) ([]byte, error) {
@@ -221,6 +302,17 @@ func convertToBytes(i interface{}) ([]byte, error) {
 	}
 }
 
+func convertToBytesWithCodec(i interface{}, c Codec) ([]byte, error) {
+	switch v := i.(type) {
+	case []byte:
+		return v, nil
+	case string:
+		return []byte(v), nil
+	default:
+		return c.Marshal(v)
+	}
+}
+
 func assignUint32(data uint32, dest any) error {
 	// Check that the destination argument is a pointer.
 	if reflect.TypeOf(dest).Kind() != reflect.Ptr {
@@ -286,13 +378,52 @@ func convertFromBytes(data []byte, i interface{}) error {
 	}
 }
 
+func convertFromBytesWithEncoding(data []byte, i interface{}, enc Encoding) error {
+	if enc == JSONEncoding {
+		return convertFromBytes(data, i)
+	}
+
+	switch i.(type) {
+	case *[]byte, *string, *UUID:
+		return convertFromBytes(data, i)
+	}
+
+	c, err := CodecFor(enc)
+	if err != nil {
+		return err
+	}
+	return c.Unmarshal(data, i)
+}
+
 type mdbFieldOptions struct {
-	Ignore bool
+	Ignore    bool
+	Index     bool
+	Unique    bool
+	Global    bool
+	NoFlatten bool
+	Expand    bool
+	Version   bool
 }
 
 func resolveFieldOptions(f reflect.StructField) mdbFieldOptions {
-	mdbTagValue := f.Tag.Get("mdb")
-	return mdbFieldOptions{
-		Ignore: strings.Contains(mdbTagValue, "ignore"),
+	opts := mdbFieldOptions{}
+	for _, opt := range strings.Split(f.Tag.Get("mdb"), ",") {
+		switch strings.TrimSpace(opt) {
+		case "ignore":
+			opts.Ignore = true
+		case "index":
+			opts.Index = true
+		case "unique":
+			opts.Unique = true
+		case "global":
+			opts.Global = true
+		case "noflatten":
+			opts.NoFlatten = true
+		case "expand":
+			opts.Expand = true
+		case "version":
+			opts.Version = true
+		}
 	}
+	return opts
 }
@@ -34,6 +34,7 @@ package kvs_test
 import (
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/matryer/is"
@@ -79,6 +80,26 @@ func TestEntryStoreValuesInTable(t *testing.T) {
 	is.Equal(newEntry.Meta, byte(reflect.Float64))
 }
 
+func TestEntryStoreWithExpiry(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	expiresAt := uint64(time.Now().Add(time.Hour).Unix())
+	is.NoErr(kvs.Store(db, kvs.Entry{TableName: "sessions", ColumnName: "token", Data: []byte("abc"), ExpiresAt: expiresAt}))
+	is.NoErr(kvs.Store(db, kvs.Entry{TableName: "sessions", ColumnName: "token", RowID: 1, Data: []byte("def"), ExpiresAt: 1}))
+
+	e := kvs.Entry{TableName: "sessions", ColumnName: "token"}
+	is.NoErr(kvs.Get(db, &e))
+	is.Equal(e.Data, []byte("abc"))
+	is.Equal(e.ExpiresAt, expiresAt)
+
+	e = kvs.Entry{TableName: "sessions", ColumnName: "token", RowID: 1}
+	is.True(kvs.Get(db, &e) != nil) // entry which expired long ago is still returned
+}
+
 type uuidstr string
 
 func (u uuidstr) String() string { return string(u) }
@@ -137,7 +158,8 @@ func TestConvertToEntries(t *testing.T) {
 	}
 
 	owner := uuidstr("39")
-	e := kvs.ConvertToEntries("test", owner, 0, source)
+	e, err := kvs.ConvertToEntries("test", owner, 0, source)
+	is.NoErr(err)
 	is.Equal(len(e), 2)
 
 	is = is.NewRelaxed(t)
@@ -256,3 +278,117 @@ func TestCompareBytesWithStruct(t *testing.T) {
 	input := []byte("{\"A\":5,\"B\":\"hello\"}")
 	is.True(kvs.CompareBytesToAny(input, TestStruct{A: 5, B: "hello"}))
 }
+
+func TestColumnsResolvesTaggedFields(t *testing.T) {
+	is := is.New(t)
+
+	type TestStruct struct {
+		ID    uint32 `mdb:"ignore"`
+		Email string `mdb:"index"`
+		Age   int
+	}
+
+	columns := kvs.Columns(TestStruct{})
+	is.Equal(len(columns), 2)
+	is.Equal(columns[0].Name, "email")
+	is.True(columns[0].Index)
+	is.Equal(columns[1].Name, "age")
+	is.True(!columns[1].Index)
+	is.Equal(columns[1].Type, reflect.TypeOf(0))
+}
+
+func TestConvertLosslessOnlyConvertsWithoutChangingValue(t *testing.T) {
+	is := is.New(t)
+
+	v, ok := kvs.ConvertLossless(200, reflect.TypeOf(uint8(0)))
+	is.True(ok)
+	is.Equal(v, uint8(200))
+
+	_, ok = kvs.ConvertLossless(300, reflect.TypeOf(uint8(0)))
+	is.True(!ok)
+
+	_, ok = kvs.ConvertLossless(2.5, reflect.TypeOf(0))
+	is.True(!ok)
+
+	_, ok = kvs.ConvertLossless(65, reflect.TypeOf(""))
+	is.True(!ok)
+}
+
+type testAudit struct {
+	CreatedBy string
+	Revision  int
+}
+
+type testAddress struct {
+	City     string
+	Postcode string
+}
+
+type testCustomer struct {
+	testAudit
+	Name      string
+	Address   testAddress
+	Billing   testAddress `mdb:"noflatten"`
+	Joined    time.Time
+	Secondary *testAddress
+}
+
+func TestConvertToEntriesFlattensNestedAndEmbeddedStructs(t *testing.T) {
+	is := is.New(t)
+
+	source := testCustomer{Name: "Amy", Address: testAddress{City: "York"}}
+	source.CreatedBy = "admin"
+
+	names := []string{}
+	for _, c := range kvs.Columns(source) {
+		names = append(names, c.Name)
+	}
+	is.Equal(names, []string{
+		"testaudit.createdby", "testaudit.revision", "name", "address.city", "address.postcode", "billing", "joined", "secondary",
+	})
+
+	e, err := kvs.ConvertToEntries("customers", kvs.RootOwner{}, 0, source)
+	is.NoErr(err)
+	is.Equal(e[0].ColumnName, "testaudit.createdby")
+	is.Equal(e[0].Data, []byte("admin"))
+	is.Equal(e[3].ColumnName, "address.city")
+	is.Equal(e[3].Data, []byte("York"))
+	is.Equal(string(e[5].Data), "{\"City\":\"\",\"Postcode\":\"\"}")
+}
+
+func TestLoadEntriesIntoFlattenedFields(t *testing.T) {
+	is := is.New(t)
+
+	entries := []kvs.Entry{
+		{ColumnName: "testaudit.revision", Data: []byte("3")},
+		{ColumnName: "address.city", Data: []byte("York")},
+		{ColumnName: "billing", Data: []byte("{\"City\":\"Leeds\"}")},
+	}
+
+	c := testCustomer{}
+	is.NoErr(kvs.LoadEntries(&c, entries))
+	is.Equal(c.Revision, 3)
+	is.Equal(c.Address.City, "York")
+	is.Equal(c.Billing.City, "Leeds")
+
+	columnType, err := kvs.ColumnType(c, "address.postcode")
+	is.NoErr(err)
+	is.Equal(columnType, reflect.TypeOf(""))
+
+	_, err = kvs.ColumnType(c, "name.first")
+	is.True(err != nil)
+}
+
+func TestLoadLegacyEntryIntoFlattenedFields(t *testing.T) {
+	is := is.New(t)
+
+	names := []string{}
+	for _, e := range kvs.ConvertToLegacyEntries("customers", kvs.RootOwner{}, 0, testCustomer{}) {
+		names = append(names, e.ColumnName)
+	}
+	is.Equal(names, []string{"testaudit", "address"})
+
+	c := testCustomer{}
+	is.NoErr(kvs.LoadEntry(&c, kvs.Entry{ColumnName: "address", Data: []byte("{\"City\":\"York\",\"Postcode\":\"YO1\"}")}))
+	is.Equal(c.Address, testAddress{City: "York", Postcode: "YO1"})
+}
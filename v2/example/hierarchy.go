@@ -59,16 +59,15 @@ func hierarchy() {
 	store.Save(healthyishCarrotCake.UUID, &Candle{Cake: healthyishCarrotCake.UUID, Lit: true})
 	store.Save(redVelvetCake.UUID, &Candle{Cake: redVelvetCake.UUID, Lit: true})
 
-	bs, err := storage.LoadAll[Cake](store, child.UUID)
-	for _, cake := range bs {
-		fmt.Printf("ROWID: %d, %+v\n", cake.ID, cake)
+	cakes, err := storage.LoadWithChildren[Cake, Candle](store, child.UUID, func(c Cake) kvs.UUID { return c.UUID })
+	if err != nil {
+		panic(err)
+	}
 
-		candles, err := storage.LoadAll[Cake](store, cake.UUID)
-		if err != nil {
-			panic(err)
-		}
+	for _, cake := range cakes {
+		fmt.Printf("ROWID: %d, %+v\n", cake.Parent.ID, cake.Parent)
 
-		for _, candle := range candles {
+		for _, candle := range cake.Children {
 			fmt.Printf("ROWID: %d, %+v\n", candle.ID, candle)
 		}
 	}
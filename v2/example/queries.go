@@ -21,7 +21,7 @@ func (b HotAirBalloon) TableName() string { return "hotairballoons" }
 type Passenger struct {
 	ID        uint32 `mdb:"ignore"`
 	FirstName string
-	Surname   string
+	Surname   string `mdb:"index"`
 	Married   bool
 	Age       int
 }
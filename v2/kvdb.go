@@ -32,15 +32,18 @@
 package kvs
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"os"
 
 	"github.com/dgraph-io/badger/v3"
+	"github.com/dgraph-io/badger/v3/pb"
 )
 
 type KVDB struct {
-	conn *badger.DB
+	conn  *badger.DB
+	codec Codec
 }
 
 func NewKVDB(db *badger.DB) (KVDB, error) {
@@ -63,10 +66,38 @@ func newKVDB(db *badger.DB) (KVDB, error) {
 	return KVDB{conn: db}, nil
 }
 
+// WithCodec returns a copy of db which stores using the given codec, unless a
+// store or table overrides it.
+func (db KVDB) WithCodec(c Codec) KVDB {
+	db.codec = c
+	return db
+}
+
+// Codec returns the codec values are stored with by default, which unless set
+// with WithCodec is JSON.
+func (db KVDB) Codec() Codec {
+	if db.codec == nil {
+		return JSONCodec{}
+	}
+	return db.codec
+}
+
 func (db KVDB) GetSeq(key []byte, bandwidth uint64) (*badger.Sequence, error) {
 	return db.conn.GetSequence(key, bandwidth)
 }
 
+// NewWriteBatch returns a batch which commits its writes over as many
+// transactions as it needs to stay within badger's transaction size limits.
+func (db KVDB) NewWriteBatch() *badger.WriteBatch {
+	return db.conn.NewWriteBatch()
+}
+
+// Subscribe calls cb with the writes to keys matching any of matches as they
+// are committed, until ctx is done or cb returns an error.
+func (db KVDB) Subscribe(ctx context.Context, cb func(kv *badger.KVList) error, matches []pb.Match) error {
+	return db.conn.Subscribe(ctx, cb, matches)
+}
+
 func (db KVDB) View(f func(txn *badger.Txn) error) error {
 	return db.conn.View(f)
 }
@@ -0,0 +1,205 @@
+// Copyright (c) 2023 Adam Prakash Stringer
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted (subject to the limitations in the disclaimer
+// below) provided that the following conditions are met:
+//
+//     * Redistributions of source code must retain the above copyright notice,
+//     this list of conditions and the following disclaimer.
+//
+//     * Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+//     * Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from this
+//     software without specific prior written permission.
+//
+// NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+// THIS LICENSE. THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR
+// BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER
+// IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package query
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/tauraamui/kvs/v2"
+	"github.com/tauraamui/kvs/v2/storage"
+)
+
+// ErrNoRows is returned by aggregates which have no value over zero rows.
+var ErrNoRows = errors.New("no rows matched")
+
+// Number constrains the types aggregates can return their result as.
+type Number interface {
+	~int | ~int8 | ~int16 | ~int32 | ~int64 |
+		~uint | ~uint8 | ~uint16 | ~uint32 | ~uint64 |
+		~float32 | ~float64
+}
+
+// scanMatching walks the entries of the rows matching q without loading them
+// into T, reading only the columns q filters on along with column. With no
+// filters and no column the walk only reads keys.
+func scanMatching[T storage.Value](s storage.Store, owner kvs.UUID, q *Query, column string, fn func(row map[string]kvs.Entry) error) error {
+	env, err := resolveEnv[T](s, owner, q)
+	if err != nil {
+		return err
+	}
+
+	scan := storage.RowScan{}
+	for _, f := range q.leafFilters() {
+		scan.Columns = append(scan.Columns, f.fieldName)
+	}
+	if len(scan.Columns) > 0 {
+		scan.Eval = q.evaluator(env)
+	}
+	if column != "" {
+		scan.Columns = append(scan.Columns, column)
+	}
+	scan.KeysOnly = len(scan.Columns) == 0
+
+	rowIDs, indexed, err := indexCandidates[T](s, owner, q, env)
+	if err != nil {
+		return err
+	}
+	if indexed {
+		scan.Rows = rowIDs
+	}
+
+	return storage.ScanRows[T](s, owner, scan, func(_ uint32, row map[string]kvs.Entry) (bool, error) {
+		return true, fn(row)
+	})
+}
+
+// eachValue calls fn with the decoded value of the numeric column for every
+// row matching q which has it stored.
+func eachValue[T storage.Value](s storage.Store, owner kvs.UUID, q *Query, column string, fn func(v any) error) error {
+	column = strings.ToLower(column)
+	fieldType, err := kvs.ColumnType(*new(T), column)
+	if err != nil {
+		return err
+	}
+	if !isNumeric(fieldType.Kind()) {
+		return fmt.Errorf("%w: cannot aggregate column %s of type %s", kvs.ErrIncomparable, column, fieldType)
+	}
+
+	return scanMatching[T](s, owner, q, column, func(row map[string]kvs.Entry) error {
+		e, ok := row[column]
+		if !ok {
+			return nil
+		}
+		v, err := kvs.DecodeBytes(e.Data, kvs.Encoding(e.Meta), fieldType)
+		if err != nil {
+			return err
+		}
+		return fn(v)
+	})
+}
+
+func isNumeric(k reflect.Kind) bool {
+	switch k {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+// toNumber converts v to N the way a Go conversion would.
+func toNumber[N Number](v any) N {
+	var n N
+	return reflect.ValueOf(v).Convert(reflect.TypeOf(n)).Interface().(N)
+}
+
+// Count returns how many of owner's rows match q, without reading any values
+// when q has no filters.
+func Count[T storage.Value](s storage.Store, owner kvs.UUID, q *Query) (int, error) {
+	count := 0
+	err := scanMatching[T](s, owner, q, "", func(map[string]kvs.Entry) error {
+		count++
+		return nil
+	})
+	return count, err
+}
+
+// Sum totals the numeric column over the rows matching q, each value is
+// converted to N before it is added.
+func Sum[T storage.Value, N Number](s storage.Store, owner kvs.UUID, q *Query, column string) (N, error) {
+	var sum N
+	err := eachValue[T](s, owner, q, column, func(v any) error {
+		sum += toNumber[N](v)
+		return nil
+	})
+	return sum, err
+}
+
+// Min returns the lowest value of the numeric column over the rows matching q
+// as N, or ErrNoRows if no row has one.
+func Min[T storage.Value, N Number](s storage.Store, owner kvs.UUID, q *Query, column string) (N, error) {
+	return extreme[T, N](s, owner, q, column, -1)
+}
+
+// Max returns the highest value of the numeric column over the rows matching
+// q as N, or ErrNoRows if no row has one.
+func Max[T storage.Value, N Number](s storage.Store, owner kvs.UUID, q *Query, column string) (N, error) {
+	return extreme[T, N](s, owner, q, column, 1)
+}
+
+func extreme[T storage.Value, N Number](s storage.Store, owner kvs.UUID, q *Query, column string, want int) (N, error) {
+	var best any
+	err := eachValue[T](s, owner, q, column, func(v any) error {
+		if best == nil {
+			best = v
+			return nil
+		}
+		c, err := kvs.CompareAny(v, best)
+		if err != nil {
+			return err
+		}
+		if c == want {
+			best = v
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if best == nil {
+		return 0, ErrNoRows
+	}
+	return toNumber[N](best), nil
+}
+
+// Avg returns the mean of the numeric column over the rows matching q, or
+// ErrNoRows if no row has a value for it.
+func Avg[T storage.Value](s storage.Store, owner kvs.UUID, q *Query, column string) (float64, error) {
+	var sum float64
+	count := 0
+	err := eachValue[T](s, owner, q, column, func(v any) error {
+		sum += toNumber[float64](v)
+		count++
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if count == 0 {
+		return 0, ErrNoRows
+	}
+	return sum / float64(count), nil
+}
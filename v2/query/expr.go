@@ -0,0 +1,147 @@
+// Copyright (c) 2023 Adam Prakash Stringer
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted (subject to the limitations in the disclaimer
+// below) provided that the following conditions are met:
+//
+//     * Redistributions of source code must retain the above copyright notice,
+//     this list of conditions and the following disclaimer.
+//
+//     * Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+//     * Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from this
+//     software without specific prior written permission.
+//
+// NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+// THIS LICENSE. THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR
+// BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER
+// IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package query
+
+import (
+	"github.com/tauraamui/kvs/v2"
+)
+
+// Expr is a condition evaluated against a whole row, so it can relate
+// several columns. A *Query is an Expr which matches rows satisfying all of
+// its filters and conditions, and Exprs combine with And, Or and Not.
+// Ordering and paging of a *Query used as an Expr are ignored.
+type Expr interface {
+	evalRow(row map[string]kvs.Entry, env evalEnv) (bool, error)
+	leafFilters() []Filter
+}
+
+type andExpr []Expr
+
+type orExpr []Expr
+
+type notExpr struct {
+	expr Expr
+}
+
+// And matches rows which satisfy every one of exprs.
+func And(exprs ...Expr) Expr {
+	return andExpr(exprs)
+}
+
+// Or matches rows which satisfy at least one of exprs.
+func Or(exprs ...Expr) Expr {
+	return orExpr(exprs)
+}
+
+// Not matches rows which don't satisfy expr.
+func Not(expr Expr) Expr {
+	return notExpr{expr: expr}
+}
+
+func (a andExpr) evalRow(row map[string]kvs.Entry, env evalEnv) (bool, error) {
+	for _, expr := range a {
+		if ok, err := expr.evalRow(row, env); err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func (a andExpr) leafFilters() []Filter {
+	return collectFilters(a)
+}
+
+func (o orExpr) evalRow(row map[string]kvs.Entry, env evalEnv) (bool, error) {
+	for _, expr := range o {
+		if ok, err := expr.evalRow(row, env); err != nil || ok {
+			return ok, err
+		}
+	}
+	return false, nil
+}
+
+func (o orExpr) leafFilters() []Filter {
+	return collectFilters(o)
+}
+
+func (n notExpr) evalRow(row map[string]kvs.Entry, env evalEnv) (bool, error) {
+	ok, err := n.expr.evalRow(row, env)
+	return !ok, err
+}
+
+func (n notExpr) leafFilters() []Filter {
+	return n.expr.leafFilters()
+}
+
+func collectFilters(exprs []Expr) []Filter {
+	filters := []Filter{}
+	for _, expr := range exprs {
+		filters = append(filters, expr.leafFilters()...)
+	}
+	return filters
+}
+
+func (q *Query) evalRow(row map[string]kvs.Entry, env evalEnv) (bool, error) {
+	if q == nil {
+		return true, nil
+	}
+
+	for _, filter := range q.filters {
+		e, ok := row[filter.fieldName]
+		if !ok {
+			// a row without the column is null for it, and can't satisfy
+			// any other filter on it
+			if filter.op == isnull {
+				continue
+			}
+			return false, nil
+		}
+		if filter.op == has {
+			if !env.members[filter.id][e.RowID] {
+				return false, nil
+			}
+			continue
+		}
+		matched, err := filter.match(e, env.fieldTypes[filter.fieldName])
+		if err != nil || !matched {
+			return false, err
+		}
+	}
+	return andExpr(q.where).evalRow(row, env)
+}
+
+func (q *Query) leafFilters() []Filter {
+	if q == nil {
+		return nil
+	}
+	return append(append([]Filter{}, q.filters...), collectFilters(q.where)...)
+}
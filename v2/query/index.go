@@ -0,0 +1,214 @@
+// Copyright (c) 2023 Adam Prakash Stringer
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted (subject to the limitations in the disclaimer
+// below) provided that the following conditions are met:
+//
+//     * Redistributions of source code must retain the above copyright notice,
+//     this list of conditions and the following disclaimer.
+//
+//     * Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+//     * Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from this
+//     software without specific prior written permission.
+//
+// NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+// THIS LICENSE. THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR
+// BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER
+// IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package query
+
+import (
+	"bytes"
+	"reflect"
+
+	"github.com/tauraamui/kvs/v2"
+	"github.com/tauraamui/kvs/v2/storage"
+)
+
+// indexCandidates narrows down the rows which can match q using the indexes
+// of T's columns. Every filter which can be answered by an index contributes
+// the set of rows it matches, and as filters are ANDed together the result is
+// their intersection. It reports false when no filter could use an index, in
+// which case every row has to be scanned instead. Rows missing from an index
+// are never candidates, see storage.Reindex. The rows found for Has filters
+// narrow down the candidates the same way.
+func indexCandidates[T storage.Value](s storage.Store, owner kvs.UUID, q *Query, env evalEnv) ([]uint32, bool, error) {
+	if q == nil {
+		return nil, false, nil
+	}
+
+	indexed := map[string]bool{}
+	for _, c := range kvs.Columns(*new(T)) {
+		indexed[c.Name] = c.Index
+	}
+
+	var candidates map[uint32]struct{}
+	for _, f := range q.filters {
+		var matched map[uint32]struct{}
+		switch {
+		case f.op == has:
+			matched = map[uint32]struct{}{}
+			for rowID := range env.members[f.id] {
+				matched[rowID] = struct{}{}
+			}
+		case indexed[f.fieldName]:
+			var ok bool
+			var err error
+			matched, ok, err = lookupIndex[T](s, owner, f, env.fieldTypes[f.fieldName])
+			if err != nil {
+				return nil, false, err
+			}
+			if !ok {
+				continue
+			}
+		default:
+			continue
+		}
+
+		if candidates == nil {
+			candidates = matched
+			continue
+		}
+		for rowID := range candidates {
+			if _, ok := matched[rowID]; !ok {
+				delete(candidates, rowID)
+			}
+		}
+	}
+
+	if candidates == nil {
+		return nil, false, nil
+	}
+
+	rowIDs := make([]uint32, 0, len(candidates))
+	for rowID := range candidates {
+		rowIDs = append(rowIDs, rowID)
+	}
+	return rowIDs, true, nil
+}
+
+// lookupIndex collects the rows whose indexed value satisfies the filter. It
+// reports false if the filter's operator or values can't be answered from the
+// index, index values are ordered encoded so only values whose ordered encoding
+// sorts the same as the field's can use it.
+func lookupIndex[T storage.Value](s storage.Store, owner kvs.UUID, f Filter, fieldType reflect.Type) (map[uint32]struct{}, bool, error) {
+	if f.op != equal && f.op != hasprefix && !f.op.ordered() {
+		return nil, false, nil
+	}
+
+	encoded := make([][]byte, 0, len(f.values))
+	for _, v := range f.values {
+		if f.op == equal {
+			converted, ok := kvs.ConvertLossless(v, fieldType)
+			if !ok {
+				return nil, false, nil
+			}
+			v = converted
+		} else if f.op == hasprefix {
+			if fieldType.Kind() != reflect.String {
+				return nil, false, nil
+			}
+		} else if !f.op.ordered() || v == nil || !kvs.OrderedBytesComparable(fieldType, reflect.TypeOf(v)) {
+			return nil, false, nil
+		}
+
+		e, err := kvs.EncodeOrdered(v)
+		if err != nil {
+			return nil, false, err
+		}
+		encoded = append(encoded, e)
+	}
+
+	matched := map[uint32]struct{}{}
+	collect := func(from []byte, accept func(value []byte) (keep, more bool)) error {
+		return storage.ScanIndex[T](s, owner, f.fieldName, from, func(value []byte, rowID uint32) (bool, error) {
+			keep, more := accept(value)
+			if keep {
+				matched[rowID] = struct{}{}
+			}
+			return more, nil
+		})
+	}
+
+	if f.op == between {
+		lower, upper := encoded[0], encoded[1]
+		err := collect(lower, func(value []byte) (bool, bool) {
+			inRange := bytes.Compare(value, upper) <= 0
+			return inRange, inRange
+		})
+		return matched, true, err
+	}
+
+	for _, e := range encoded {
+		e := e
+		var err error
+		switch f.op {
+		case equal:
+			err = collect(e, func(value []byte) (bool, bool) {
+				same := bytes.Equal(value, e)
+				return same, same
+			})
+		case lessthan, lessthanorequal:
+			err = collect(nil, func(value []byte) (bool, bool) {
+				in := f.op.satisfiedBy(bytes.Compare(value, e))
+				return in, in
+			})
+		case hasprefix:
+			// strings are stored as they are, so their prefixes sort together
+			err = collect(e, func(value []byte) (bool, bool) {
+				in := bytes.HasPrefix(value, e)
+				return in, in
+			})
+		case greaterthan, greaterthanorequal:
+			err = collect(e, func(value []byte) (bool, bool) {
+				return f.op.satisfiedBy(bytes.Compare(value, e)), true
+			})
+		}
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	return matched, true, nil
+}
+
+// lookupMembers collects the rows whose expanded column holds one of the Has
+// filter's values, an element of a slice or a key of a map, from the column's
+// stored elements.
+func lookupMembers[T storage.Value](s storage.Store, owner kvs.UUID, f Filter, fieldType reflect.Type) (map[uint32]bool, error) {
+	rows := map[uint32]bool{}
+	err := storage.ScanElements[T](s, owner, f.fieldName, func(rowID uint32, key, value any) (bool, error) {
+		if rows[rowID] {
+			return true, nil
+		}
+		member := value
+		if fieldType.Kind() == reflect.Map {
+			member = key
+		}
+		for _, v := range f.values {
+			if c, err := kvs.CompareAny(member, v); (err == nil && c == 0) || reflect.DeepEqual(member, v) {
+				rows[rowID] = true
+				break
+			}
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
@@ -0,0 +1,391 @@
+// Copyright (c) 2023 Adam Prakash Stringer
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted (subject to the limitations in the disclaimer
+// below) provided that the following conditions are met:
+//
+//     * Redistributions of source code must retain the above copyright notice,
+//     this list of conditions and the following disclaimer.
+//
+//     * Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+//     * Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from this
+//     software without specific prior written permission.
+//
+// NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+// THIS LICENSE. THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR
+// BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER
+// IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package query
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/tauraamui/kvs/v2"
+	"github.com/tauraamui/kvs/v2/storage"
+)
+
+type Direction int
+
+const (
+	Asc Direction = iota
+	Desc
+)
+
+func (d Direction) String() string {
+	if d == Desc {
+		return "desc"
+	}
+	return "asc"
+}
+
+type ordering struct {
+	fieldName string
+	dir       Direction
+}
+
+// sortKey holds the values a row is ordered by, rows which are equal on all
+// of them are ordered by their row ID.
+type sortKey struct {
+	values []any
+	rowID  uint32
+}
+
+type keyedRow[T any] struct {
+	row T
+	key sortKey
+}
+
+func (q *Query) sortKeyOf(row any) (sortKey, error) {
+	rowID, err := storage.RowIDOf(row)
+	if err != nil {
+		return sortKey{}, err
+	}
+	key := sortKey{rowID: rowID}
+	for _, o := range q.orderings {
+		v, err := kvs.ColumnValue(row, o.fieldName)
+		if err != nil {
+			return sortKey{}, err
+		}
+		key.values = append(key.values, v)
+	}
+	return key, nil
+}
+
+func (q *Query) compareKeys(a, b sortKey) (int, error) {
+	for i, o := range q.orderings {
+		c, err := kvs.CompareAny(a.values[i], b.values[i])
+		if err != nil {
+			return 0, err
+		}
+		if c != 0 {
+			if o.dir == Desc {
+				c = -c
+			}
+			return c, nil
+		}
+	}
+	switch {
+	case a.rowID < b.rowID:
+		return -1, nil
+	case a.rowID > b.rowID:
+		return 1, nil
+	}
+	return 0, nil
+}
+
+func sortRows[T any](q *Query, rows []T) ([]keyedRow[T], error) {
+	keyed := make([]keyedRow[T], 0, len(rows))
+	for _, row := range rows {
+		key, err := q.sortKeyOf(row)
+		if err != nil {
+			return nil, err
+		}
+		keyed = append(keyed, keyedRow[T]{row: row, key: key})
+	}
+
+	var sortErr error
+	sort.SliceStable(keyed, func(i, j int) bool {
+		c, err := q.compareKeys(keyed[i].key, keyed[j].key)
+		if err != nil && sortErr == nil {
+			sortErr = err
+		}
+		return c < 0
+	})
+	return keyed, sortErr
+}
+
+// Cursors of ordered queries hold the sort values of the row they were taken
+// at rather than just its ID, so the position survives the row being deleted.
+const orderedCursorMarker = 'o'
+
+func (q *Query) cursorFor(key sortKey) (storage.Cursor, error) {
+	payload := []byte{orderedCursorMarker}
+	payload = binary.AppendUvarint(payload, uint64(len(key.values)))
+	for _, v := range key.values {
+		encoded, err := kvs.EncodeOrdered(v)
+		if err != nil {
+			return "", err
+		}
+		payload = binary.AppendUvarint(payload, uint64(len(encoded)))
+		payload = append(payload, encoded...)
+	}
+	payload = binary.BigEndian.AppendUint32(payload, key.rowID)
+	return storage.Cursor(base64.RawURLEncoding.EncodeToString(payload)), nil
+}
+
+func (q *Query) parseCursor(c storage.Cursor, fieldTypes map[string]reflect.Type) (*sortKey, error) {
+	if c == "" {
+		return nil, nil
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(string(c))
+	if err != nil || len(payload) == 0 || payload[0] != orderedCursorMarker {
+		return nil, fmt.Errorf("%w: not a cursor of an ordered query", storage.ErrInvalidCursor)
+	}
+	payload = payload[1:]
+
+	count, n := binary.Uvarint(payload)
+	if n <= 0 || count != uint64(len(q.orderings)) {
+		return nil, fmt.Errorf("%w: cursor does not match the query's ordering", storage.ErrInvalidCursor)
+	}
+	payload = payload[n:]
+
+	key := &sortKey{}
+	for _, o := range q.orderings {
+		size, n := binary.Uvarint(payload)
+		if n <= 0 || uint64(len(payload)-n) < size {
+			return nil, fmt.Errorf("%w: truncated cursor", storage.ErrInvalidCursor)
+		}
+		v, err := kvs.DecodeBytes(payload[n:n+int(size)], kvs.OrderedEncoding, fieldTypes[o.fieldName])
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", storage.ErrInvalidCursor, err)
+		}
+		key.values = append(key.values, v)
+		payload = payload[n+int(size):]
+	}
+	if len(payload) != 4 {
+		return nil, fmt.Errorf("%w: truncated cursor", storage.ErrInvalidCursor)
+	}
+	key.rowID = binary.BigEndian.Uint32(payload)
+	return key, nil
+}
+
+// orderedPage applies the page of an ordered query to rows which are fed to
+// it in order, handing those within the page on to emit.
+type orderedPage[T any] struct {
+	q       *Query
+	after   *sortKey
+	skipped int
+	emitted int
+	last    sortKey
+	more    bool
+	emit    func(row T) (bool, error)
+	// proj is the query's projection widened to the columns rows are ordered
+	// by, hidden lists those which have to be cleared again afterwards.
+	proj   storage.Projection
+	hidden []string
+}
+
+// add reports whether further rows are wanted.
+func (p *orderedPage[T]) add(r keyedRow[T]) (bool, error) {
+	if p.after != nil {
+		c, err := p.q.compareKeys(r.key, *p.after)
+		if err != nil {
+			return false, err
+		}
+		if c <= 0 {
+			return true, nil
+		}
+	}
+	if p.q.page.Limit > 0 && p.emitted == p.q.page.Limit {
+		p.more = true
+		return false, nil
+	}
+	if p.skipped < p.q.page.Offset {
+		p.skipped++
+		return true, nil
+	}
+
+	for _, column := range p.hidden {
+		if err := kvs.SetColumnValue(&r.row, column, nil); err != nil {
+			return false, err
+		}
+	}
+	p.emitted++
+	p.last = r.key
+	return p.emit(r.row)
+}
+
+// cursor returns the cursor of the next page, if there is one.
+func (p *orderedPage[T]) cursor() (storage.Cursor, error) {
+	if !p.more {
+		return "", nil
+	}
+	return p.q.cursorFor(p.last)
+}
+
+// runOrdered runs a query with an ordering, handing the rows of its page to
+// emit in order. When the first column it is ordered by is indexed the rows
+// are read in index order, a group of equal values at a time, and reading
+// stops as soon as the page is full. Otherwise every matching row is loaded
+// and sorted in memory.
+func runOrdered[T storage.Value](s storage.Store, owner kvs.UUID, q *Query, env evalEnv, emit func(row T) (bool, error)) (storage.Cursor, error) {
+	fieldTypes := env.fieldTypes
+	after, err := q.parseCursor(q.page.After, fieldTypes)
+	if err != nil {
+		return "", err
+	}
+
+	rowIDs, indexed, err := indexCandidates[T](s, owner, q, env)
+	if err != nil {
+		return "", err
+	}
+	pred := q.evaluator(env)
+	page := &orderedPage[T]{q: q, after: after, emit: emit, proj: q.projection()}
+	if len(page.proj.Columns) > 0 {
+		page.proj.Columns = append([]string{}, page.proj.Columns...)
+		for _, o := range q.orderings {
+			if !selects(q.columns, o.fieldName) {
+				page.proj.Columns = append(page.proj.Columns, o.fieldName)
+				page.hidden = append(page.hidden, o.fieldName)
+			}
+		}
+	}
+
+	if orderIndexed[T](q, fieldTypes) {
+		var candidates map[uint32]struct{}
+		if indexed {
+			candidates = map[uint32]struct{}{}
+			for _, rowID := range rowIDs {
+				candidates[rowID] = struct{}{}
+			}
+		}
+		if err := walkOrderIndex(s, owner, q, after, candidates, pred, page); err != nil {
+			return "", err
+		}
+		return page.cursor()
+	}
+
+	var rows []T
+	if indexed {
+		rows, _, err = storage.LoadRowsProjectedPage[T](s, owner, rowIDs, page.proj, pred, storage.Page{})
+	} else {
+		rows, _, err = storage.LoadProjectedPage[T](s, owner, page.proj, pred, storage.Page{})
+	}
+	if err != nil {
+		return "", err
+	}
+
+	keyed, err := sortRows(q, rows)
+	if err != nil {
+		return "", err
+	}
+	for _, r := range keyed {
+		more, err := page.add(r)
+		if err != nil {
+			return "", err
+		}
+		if !more {
+			break
+		}
+	}
+	return page.cursor()
+}
+
+func orderIndexed[T storage.Value](q *Query, fieldTypes map[string]reflect.Type) bool {
+	first := q.orderings[0]
+	for _, c := range kvs.Columns(*new(T)) {
+		if c.Name == first.fieldName {
+			t := fieldTypes[first.fieldName]
+			return c.Index && kvs.OrderedBytesComparable(t, t)
+		}
+	}
+	return false
+}
+
+func walkOrderIndex[T storage.Value](s storage.Store, owner kvs.UUID, q *Query, after *sortKey, candidates map[uint32]struct{}, pred storage.RowEvaluator, page *orderedPage[T]) error {
+	first := q.orderings[0]
+	scan := storage.ScanIndex[T]
+	if first.dir == Desc {
+		scan = storage.ScanIndexReverse[T]
+	}
+
+	var from []byte
+	if after != nil {
+		encoded, err := kvs.EncodeOrdered(after.values[0])
+		if err != nil {
+			return err
+		}
+		from = encoded
+	}
+
+	group := []uint32{}
+	var groupValue []byte
+	flush := func() (bool, error) {
+		if len(group) == 0 {
+			return true, nil
+		}
+		rows, _, err := storage.LoadRowsProjectedPage[T](s, owner, group, page.proj, pred, storage.Page{})
+		if err != nil {
+			return false, err
+		}
+		group = group[:0]
+
+		keyed, err := sortRows(q, rows)
+		if err != nil {
+			return false, err
+		}
+		for _, r := range keyed {
+			more, err := page.add(r)
+			if err != nil || !more {
+				return false, err
+			}
+		}
+		return true, nil
+	}
+
+	more := true
+	if err := scan(s, owner, first.fieldName, from, func(value []byte, rowID uint32) (bool, error) {
+		if groupValue != nil && !bytes.Equal(value, groupValue) {
+			var err error
+			if more, err = flush(); err != nil || !more {
+				return false, err
+			}
+		}
+		groupValue = append([]byte{}, value...)
+
+		if candidates != nil {
+			if _, ok := candidates[rowID]; !ok {
+				return true, nil
+			}
+		}
+		group = append(group, rowID)
+		return true, nil
+	}); err != nil {
+		return err
+	}
+
+	if more {
+		_, err := flush()
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,557 @@
+// Copyright (c) 2023 Adam Prakash Stringer
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted (subject to the limitations in the disclaimer
+// below) provided that the following conditions are met:
+//
+//     * Redistributions of source code must retain the above copyright notice,
+//     this list of conditions and the following disclaimer.
+//
+//     * Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+//     * Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from this
+//     software without specific prior written permission.
+//
+// NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+// THIS LICENSE. THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR
+// BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER
+// IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package query
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/tauraamui/kvs/v2"
+	"github.com/tauraamui/kvs/v2/storage"
+)
+
+// ParseError reports where in the source a query failed to parse.
+type ParseError struct {
+	// Pos is the byte offset into the source the error was found at.
+	Pos int
+	Msg string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("query: %s at position %d", e.Msg, e.Pos)
+}
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenString
+	tokenNumber
+	tokenOperator
+	tokenLParen
+	tokenRParen
+	tokenComma
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func lex(src string) ([]token, error) {
+	tokens := []token{}
+	for i := 0; i < len(src); {
+		c := rune(src[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '(':
+			tokens = append(tokens, token{kind: tokenLParen, text: "(", pos: i})
+			i++
+		case c == ')':
+			tokens = append(tokens, token{kind: tokenRParen, text: ")", pos: i})
+			i++
+		case c == ',':
+			tokens = append(tokens, token{kind: tokenComma, text: ",", pos: i})
+			i++
+		case c == '"':
+			end := i + 1
+			for end < len(src) && src[end] != '"' {
+				if src[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(src) {
+				return nil, &ParseError{Pos: i, Msg: "unterminated string"}
+			}
+			tokens = append(tokens, token{kind: tokenString, text: src[i : end+1], pos: i})
+			i = end + 1
+		case c == '=' || c == '<' || c == '>' || c == '!':
+			end := i + 1
+			if end < len(src) && src[end] == '=' {
+				end++
+			}
+			op := src[i:end]
+			if op == "!" {
+				return nil, &ParseError{Pos: i, Msg: `expected "!="`}
+			}
+			if op == "==" {
+				op = "="
+			}
+			tokens = append(tokens, token{kind: tokenOperator, text: op, pos: i})
+			i = end
+		case unicode.IsDigit(c) || (c == '-' && i+1 < len(src) && (unicode.IsDigit(rune(src[i+1])) || src[i+1] == '.')) || c == '.':
+			end := i + 1
+			for end < len(src) {
+				d := src[end]
+				isExponentSign := (d == '+' || d == '-') && (src[end-1] == 'e' || src[end-1] == 'E')
+				if !unicode.IsDigit(rune(d)) && d != '.' && d != 'e' && d != 'E' && !isExponentSign {
+					break
+				}
+				end++
+			}
+			tokens = append(tokens, token{kind: tokenNumber, text: src[i:end], pos: i})
+			i = end
+		case unicode.IsLetter(c) || c == '_':
+			end := i + 1
+			for end < len(src) && (unicode.IsLetter(rune(src[end])) || unicode.IsDigit(rune(src[end])) || src[end] == '_' || src[end] == '.') {
+				end++
+			}
+			tokens = append(tokens, token{kind: tokenIdent, text: src[i:end], pos: i})
+			i = end
+		default:
+			return nil, &ParseError{Pos: i, Msg: fmt.Sprintf("unexpected character %q", c)}
+		}
+	}
+	return append(tokens, token{kind: tokenEOF, pos: len(src)}), nil
+}
+
+var keywords = map[string]bool{"and": true, "or": true, "not": true, "between": true, "in": true, "true": true, "false": true}
+
+// textualOperators are only keywords where an operator is expected, so they
+// remain usable as field names.
+var textualOperators = map[string]operator{
+	"hasprefix": hasprefix,
+	"hassuffix": hassuffix,
+	"contains":  contains,
+	"matches":   matches,
+	"eqfold":    equalfold,
+}
+
+type parser struct {
+	tokens []token
+	i      int
+	// fieldType resolves the type of a field when parsing for a known type.
+	fieldType func(name string) (reflect.Type, error)
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.i]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.i]
+	if t.kind != tokenEOF {
+		p.i++
+	}
+	return t
+}
+
+func (t token) is(keyword string) bool {
+	return t.kind == tokenIdent && strings.EqualFold(t.text, keyword)
+}
+
+func (t token) describe() string {
+	if t.kind == tokenEOF {
+		return "end of query"
+	}
+	return strconv.Quote(t.text)
+}
+
+func (p *parser) errorf(t token, format string, args ...any) error {
+	return &ParseError{Pos: t.pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (p *parser) parseOr() (Expr, error) {
+	exprs := []Expr{}
+	for {
+		expr, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, expr)
+		if !p.peek().is("or") {
+			break
+		}
+		p.next()
+	}
+	if len(exprs) == 1 {
+		return exprs[0], nil
+	}
+	return Or(exprs...), nil
+}
+
+func (p *parser) parseAnd() (Expr, error) {
+	exprs := []Expr{}
+	for {
+		expr, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, expr)
+		if !p.peek().is("and") {
+			break
+		}
+		p.next()
+	}
+	if len(exprs) == 1 {
+		return exprs[0], nil
+	}
+	return And(exprs...), nil
+}
+
+func (p *parser) parseUnary() (Expr, error) {
+	t := p.peek()
+	switch {
+	case t.is("not"):
+		p.next()
+		expr, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return Not(expr), nil
+	case t.kind == tokenLParen:
+		p.next()
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if closing := p.next(); closing.kind != tokenRParen {
+			return nil, p.errorf(closing, "expected \")\" but found %s", closing.describe())
+		}
+		return expr, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *parser) parseComparison() (Expr, error) {
+	field := p.next()
+	if field.kind != tokenIdent || keywords[strings.ToLower(field.text)] {
+		return nil, p.errorf(field, "expected field name but found %s", field.describe())
+	}
+	name := strings.ToLower(field.text)
+
+	var fieldType reflect.Type
+	if p.fieldType != nil {
+		t, err := p.fieldType(name)
+		if err != nil {
+			return nil, p.errorf(field, "unknown field %s", name)
+		}
+		fieldType = t
+	}
+
+	filter := New().Filter(name)
+	op := p.next()
+	switch {
+	case op.kind == tokenOperator:
+		v, err := p.parseLiteral(name, fieldType)
+		if err != nil {
+			return nil, err
+		}
+		switch op.text {
+		case "=":
+			return filter.Eq(v), nil
+		case "!=":
+			return Not(filter.Eq(v)), nil
+		case "<":
+			return filter.Lt(v), nil
+		case "<=":
+			return filter.Lte(v), nil
+		case ">":
+			return filter.Gt(v), nil
+		case ">=":
+			return filter.Gte(v), nil
+		}
+	case op.is("between"):
+		lower, err := p.parseLiteral(name, fieldType)
+		if err != nil {
+			return nil, err
+		}
+		if and := p.next(); !and.is("and") {
+			return nil, p.errorf(and, "expected AND but found %s", and.describe())
+		}
+		upper, err := p.parseLiteral(name, fieldType)
+		if err != nil {
+			return nil, err
+		}
+		return filter.Between(lower, upper), nil
+	case op.is("in"):
+		values, err := p.parseList(name, fieldType)
+		if err != nil {
+			return nil, err
+		}
+		return filter.Eq(values...), nil
+	case op.kind == tokenIdent && textualOperators[strings.ToLower(op.text)] != undefined:
+		literal := p.peek()
+		v, err := p.parseLiteral(name, fieldType)
+		if err != nil {
+			return nil, err
+		}
+		text, ok := v.(string)
+		if !ok {
+			return nil, p.errorf(literal, "%s requires a string value", strings.ToLower(op.text))
+		}
+		switch textualOperators[strings.ToLower(op.text)] {
+		case hasprefix:
+			return filter.HasPrefix(text), nil
+		case hassuffix:
+			return filter.HasSuffix(text), nil
+		case contains:
+			return filter.Contains(text), nil
+		case equalfold:
+			return filter.EqFold(text), nil
+		case matches:
+			if _, err := regexp.Compile(text); err != nil {
+				return nil, p.errorf(literal, "invalid regular expression: %s", err)
+			}
+			return filter.Matches(text), nil
+		}
+	case op.is("has"):
+		// the values are elements, or keys of a map
+		var memberType reflect.Type
+		if fieldType != nil {
+			switch fieldType.Kind() {
+			case reflect.Slice:
+				memberType = fieldType.Elem()
+			case reflect.Map:
+				memberType = fieldType.Key()
+			}
+		}
+		if p.peek().kind == tokenLParen {
+			values, err := p.parseList(name, memberType)
+			if err != nil {
+				return nil, err
+			}
+			return filter.Has(values...), nil
+		}
+		v, err := p.parseLiteral(name, memberType)
+		if err != nil {
+			return nil, err
+		}
+		return filter.Has(v), nil
+	case op.is("exists"):
+		return filter.Exists(), nil
+	case op.is("is"):
+		negated := p.peek().is("not")
+		if negated {
+			p.next()
+		}
+		if null := p.next(); !null.is("null") {
+			return nil, p.errorf(null, "expected NULL but found %s", null.describe())
+		}
+		if negated {
+			return Not(filter.IsNull()), nil
+		}
+		return filter.IsNull(), nil
+	case op.is("not") && p.peek().is("in"):
+		p.next()
+		values, err := p.parseList(name, fieldType)
+		if err != nil {
+			return nil, err
+		}
+		return Not(filter.Eq(values...)), nil
+	}
+	return nil, p.errorf(op, "expected operator but found %s", op.describe())
+}
+
+func (p *parser) parseList(name string, fieldType reflect.Type) ([]any, error) {
+	if open := p.next(); open.kind != tokenLParen {
+		return nil, p.errorf(open, "expected \"(\" but found %s", open.describe())
+	}
+	values := []any{}
+	for {
+		v, err := p.parseLiteral(name, fieldType)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+
+		t := p.next()
+		if t.kind == tokenRParen {
+			return values, nil
+		}
+		if t.kind != tokenComma {
+			return nil, p.errorf(t, "expected \",\" or \")\" but found %s", t.describe())
+		}
+	}
+}
+
+func (p *parser) parseLiteral(name string, fieldType reflect.Type) (any, error) {
+	t := p.next()
+	var v any
+	switch {
+	case t.kind == tokenString:
+		s, err := strconv.Unquote(t.text)
+		if err != nil {
+			return nil, p.errorf(t, "invalid string %s", t.text)
+		}
+		v = s
+	case t.kind == tokenNumber:
+		n, err := parseNumber(t.text)
+		if err != nil {
+			return nil, p.errorf(t, "invalid number %s", t.text)
+		}
+		v = n
+	case t.is("true"):
+		v = true
+	case t.is("false"):
+		v = false
+	default:
+		return nil, p.errorf(t, "expected value but found %s", t.describe())
+	}
+
+	if fieldType == nil {
+		return v, nil
+	}
+	converted, err := convertLiteral(v, fieldType)
+	if err != nil {
+		return nil, p.errorf(t, "%s for field %s", err, name)
+	}
+	return converted, nil
+}
+
+// parseNumber parses integers as int64, or uint64 if they are too large for
+// it, and everything else as float64.
+func parseNumber(text string) (any, error) {
+	if !strings.ContainsAny(text, ".eE") {
+		if i, err := strconv.ParseInt(text, 10, 64); err == nil {
+			return i, nil
+		}
+		if u, err := strconv.ParseUint(text, 10, 64); err == nil {
+			return u, nil
+		}
+	}
+	return strconv.ParseFloat(text, 64)
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// convertLiteral converts a literal to the field's type where that loses
+// nothing, times are written as RFC 3339 strings. Literals which can't be
+// converted are kept as they are if they can still be compared to the field.
+func convertLiteral(v any, t reflect.Type) (any, error) {
+	if t == timeType {
+		s, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("expected an RFC 3339 time string")
+		}
+		parsed, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid time %q", s)
+		}
+		return parsed, nil
+	}
+
+	if converted, ok := kvs.ConvertLossless(v, t); ok {
+		return converted, nil
+	}
+	if literalClass(reflect.TypeOf(v).Kind()) != literalClass(t.Kind()) {
+		return nil, fmt.Errorf("cannot compare %T value with %s", v, t)
+	}
+	return v, nil
+}
+
+func literalClass(k reflect.Kind) string {
+	switch {
+	case isNumeric(k):
+		return "number"
+	case k == reflect.String:
+		return "string"
+	case k == reflect.Bool:
+		return "bool"
+	}
+	return k.String()
+}
+
+// Parse compiles a textual query into a *Query, for example:
+//
+//	surname = "Hax" AND (age < 30 OR married = true)
+//
+// Comparisons are written as field = value, with !=, <, <=, > and >= as the
+// other operators, along with field BETWEEN lower AND upper, field IN (a, b)
+// and field NOT IN (a, b). String fields can also be compared with
+// HASPREFIX, HASSUFFIX, CONTAINS, EQFOLD and MATCHES, the latter taking a
+// regular expression. field EXISTS matches rows with the field stored, and
+// field IS NULL matches rows without it or with a nil value stored, as the
+// Exists and IsNull filters do. Expanded columns are filtered with field HAS
+// value or field HAS (a, b), as the Has filter does.
+//
+// Comparisons combine with AND, OR, NOT and parentheses, AND binding tighter
+// than OR. Values are double quoted strings, numbers, or true and false.
+// Keywords are case insensitive. An empty query matches every row.
+func Parse(src string) (*Query, error) {
+	return parse(src, nil)
+}
+
+// ParseFor is Parse for queries on T, field names are checked against T's
+// columns and values are converted to the type of their field, which lets
+// time fields be compared with RFC 3339 strings.
+func ParseFor[T storage.Value](src string) (*Query, error) {
+	v := *new(T)
+	return parse(src, func(name string) (reflect.Type, error) {
+		return kvs.ColumnType(v, name)
+	})
+}
+
+func parse(src string, fieldType func(name string) (reflect.Type, error)) (*Query, error) {
+	tokens, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+
+	q := New()
+	if tokens[0].kind == tokenEOF {
+		return q, nil
+	}
+
+	p := &parser{tokens: tokens, fieldType: fieldType}
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokenEOF {
+		return nil, p.errorf(t, "unexpected %s", t.describe())
+	}
+
+	// comparisons ANDed at the top level become the query's own filters, so
+	// they can be answered from indexes
+	conjuncts := []Expr{expr}
+	if and, ok := expr.(andExpr); ok {
+		conjuncts = and
+	}
+	for _, c := range conjuncts {
+		if cq, ok := c.(*Query); ok {
+			q.filters = append(q.filters, cq.filters...)
+			continue
+		}
+		q.where = append(q.where, c)
+	}
+	return q, nil
+}
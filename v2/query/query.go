@@ -32,12 +32,23 @@
 package query
 
 import (
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync/atomic"
+
 	"github.com/tauraamui/kvs/v2"
 	"github.com/tauraamui/kvs/v2/storage"
 )
 
 type Query struct {
-	filters []Filter
+	filters   []Filter
+	where     []Expr
+	columns   []string
+	orderings []ordering
+	page      storage.Page
 }
 
 type operator int64
@@ -46,22 +57,95 @@ const (
 	undefined operator = iota
 	equal
 	lessthan
+	lessthanorequal
+	greaterthan
+	greaterthanorequal
+	between
+	hasprefix
+	hassuffix
+	contains
+	matches
+	equalfold
+	exists
+	isnull
+	has
 )
 
 func (op operator) String() string {
 	switch op {
 	case equal:
 		return "equal"
+	case lessthan:
+		return "lessthan"
+	case lessthanorequal:
+		return "lessthanorequal"
+	case greaterthan:
+		return "greaterthan"
+	case greaterthanorequal:
+		return "greaterthanorequal"
+	case between:
+		return "between"
+	case hasprefix:
+		return "hasprefix"
+	case hassuffix:
+		return "hassuffix"
+	case contains:
+		return "contains"
+	case matches:
+		return "matches"
+	case equalfold:
+		return "equalfold"
+	case exists:
+		return "exists"
+	case isnull:
+		return "isnull"
+	case has:
+		return "has"
 	default:
 		return "undefined"
 	}
 }
 
+func (op operator) ordered() bool {
+	return op >= lessthan && op <= between
+}
+
+// textual operators only apply to string fields.
+func (op operator) textual() bool {
+	return op >= hasprefix && op <= equalfold
+}
+
+// matchString reports whether s satisfies the textual operator for value v,
+// which is a string or for matches a compiled regular expression.
+func (op operator) matchString(s string, v any) bool {
+	if op == matches {
+		return v.(*regexp.Regexp).MatchString(s)
+	}
+	value := reflect.ValueOf(v).String()
+	switch op {
+	case hasprefix:
+		return strings.HasPrefix(s, value)
+	case hassuffix:
+		return strings.HasSuffix(s, value)
+	case contains:
+		return strings.Contains(s, value)
+	case equalfold:
+		return strings.EqualFold(s, value)
+	}
+	return false
+}
+
 type Filter struct {
 	q         *Query
 	fieldName string
 	op        operator
 	values    []any
+	// err holds an error found while building the filter, it is reported
+	// once the query is run.
+	err error
+	// id tells Has filters apart, as the rows they match are looked up
+	// before the rows are evaluated.
+	id uint64
 }
 
 func (f Filter) cmp(d []byte) bool {
@@ -73,41 +157,445 @@ func (f Filter) cmp(d []byte) bool {
 	return false
 }
 
+func (f Filter) match(e kvs.Entry, fieldType reflect.Type) (bool, error) {
+	enc := kvs.Encoding(e.Meta)
+	switch f.op {
+	case exists:
+		return true, nil
+	case isnull:
+		return storedNull(e, fieldType)
+	}
+
+	if f.op == equal {
+		if enc == kvs.JSONEncoding {
+			return f.cmp(e.Data), nil
+		}
+		return f.cmpEncoded(e.Data, enc, fieldType)
+	}
+
+	if f.op.textual() {
+		stored, err := kvs.DecodeBytes(e.Data, enc, fieldType)
+		if err != nil {
+			return false, err
+		}
+		text := reflect.ValueOf(stored).String()
+		for _, v := range f.values {
+			if f.op.matchString(text, v) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+
+	if !f.op.ordered() {
+		return true, nil
+	}
+
+	if f.op == between {
+		lower, err := kvs.CompareBytesToAnyOrdered(e.Data, enc, fieldType, f.values[0])
+		if err != nil {
+			return false, err
+		}
+		upper, err := kvs.CompareBytesToAnyOrdered(e.Data, enc, fieldType, f.values[1])
+		if err != nil {
+			return false, err
+		}
+		return lower >= 0 && upper <= 0, nil
+	}
+
+	for _, v := range f.values {
+		c, err := kvs.CompareBytesToAnyOrdered(e.Data, enc, fieldType, v)
+		if err != nil {
+			return false, err
+		}
+		if f.op.satisfiedBy(c) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// storedNull reports whether a stored entry holds a nil pointer, slice, map
+// or interface.
+func storedNull(e kvs.Entry, fieldType reflect.Type) (bool, error) {
+	switch fieldType.Kind() {
+	case reflect.Pointer, reflect.Slice, reflect.Map, reflect.Interface:
+	default:
+		return false, nil
+	}
+	stored, err := kvs.DecodeBytes(e.Data, kvs.Encoding(e.Meta), fieldType)
+	if err != nil {
+		return false, err
+	}
+	v := reflect.ValueOf(stored)
+	return !v.IsValid() || v.IsNil(), nil
+}
+
+// cmpEncoded is the equality check for data which is not JSON encoded, it has
+// to decode into the field's own type as the encoded data is not self describing.
+func (f Filter) cmpEncoded(d []byte, enc kvs.Encoding, fieldType reflect.Type) (bool, error) {
+	for _, v := range f.values {
+		c, err := kvs.CompareBytesToAnyOrdered(d, enc, fieldType, v)
+		if err == nil {
+			if c == 0 {
+				return true, nil
+			}
+			continue
+		}
+		if !errors.Is(err, kvs.ErrIncomparable) {
+			return false, err
+		}
+		stored, err := kvs.DecodeBytes(d, enc, fieldType)
+		if err != nil {
+			return false, err
+		}
+		if reflect.DeepEqual(stored, v) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (op operator) satisfiedBy(c int) bool {
+	switch op {
+	case lessthan:
+		return c < 0
+	case lessthanorequal:
+		return c <= 0
+	case greaterthan:
+		return c > 0
+	case greaterthanorequal:
+		return c >= 0
+	}
+	return false
+}
+
+// validate checks the filter's values can be compared against the given
+// field type, so a mismatch is reported up front instead of matching nothing.
+func (f Filter) validate(fieldType reflect.Type) error {
+	if f.err != nil {
+		return fmt.Errorf("filter on field %s: %w", f.fieldName, f.err)
+	}
+	if f.op.textual() {
+		if fieldType.Kind() != reflect.String {
+			return fmt.Errorf("filter on field %s of type %s: %s requires a string field: %w", f.fieldName, fieldType, f.op, kvs.ErrIncomparable)
+		}
+		return nil
+	}
+	if !f.op.ordered() {
+		return nil
+	}
+	if f.op == between && len(f.values) != 2 {
+		return fmt.Errorf("filter on field %s: between requires exactly 2 values", f.fieldName)
+	}
+	zero := reflect.Zero(fieldType).Interface()
+	for _, v := range f.values {
+		if _, err := kvs.CompareAny(zero, v); err != nil {
+			if errors.Is(err, kvs.ErrIncomparable) {
+				return fmt.Errorf("filter on field %s of type %s: %s with value of type %T: %w", f.fieldName, fieldType, f.op, v, err)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
 func New() *Query {
 	return &Query{}
 }
 
 func Run[T storage.Value](s storage.Store, owner kvs.UUID, q *Query) ([]T, error) {
-	return storage.LoadAllWithEvaluator[T](s, owner, func(e kvs.Entry) bool {
-		if q == nil || len(q.filters) == 0 {
-			return true
-		}
+	dest, _, err := RunPage[T](s, owner, q)
+	return dest, err
+}
 
-		captured := true
-		for i, filter := range q.filters {
-			if i > 0 && !captured {
-				return false
-			}
-			if filter.fieldName == e.ColumnName {
-				if filter.op == equal {
-					if !filter.cmp(e.Data) {
-						captured = false
+// RunPage runs the query like Run, also returning the cursor to resume from
+// with After for the next page. The cursor is empty once there are no more
+// matching rows.
+func RunPage[T storage.Value](s storage.Store, owner kvs.UUID, q *Query) ([]T, storage.Cursor, error) {
+	dest := []T{}
+	cursor, err := ForEachPage(s, owner, q, func(row T) error {
+		dest = append(dest, row)
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return dest, cursor, nil
+}
+
+// ForEach hands the rows Run would return to fn one at a time rather than
+// collecting them, returning storage.ErrStop from fn stops early without an
+// error. Rows of queries ordered by a column without an index still have to
+// be sorted in memory first.
+func ForEach[T storage.Value](s storage.Store, owner kvs.UUID, q *Query, fn func(row T) error) error {
+	_, err := ForEachPage(s, owner, q, fn)
+	return err
+}
+
+// ForEachPage is ForEach, also returning the cursor RunPage would.
+func ForEachPage[T storage.Value](s storage.Store, owner kvs.UUID, q *Query, fn func(row T) error) (storage.Cursor, error) {
+	env, err := resolveEnv[T](s, owner, q)
+	if err != nil {
+		return "", err
+	}
+
+	var page storage.Page
+	if q != nil {
+		page = q.page
+		if len(q.orderings) > 0 {
+			return runOrdered(s, owner, q, env, func(row T) (bool, error) {
+				if err := fn(row); err != nil {
+					if errors.Is(err, storage.ErrStop) {
+						return false, nil
 					}
+					return false, err
 				}
-			}
+				return true, nil
+			})
 		}
+	}
 
-		return captured
-	})
+	rowIDs, indexed, err := indexCandidates[T](s, owner, q, env)
+	if err != nil {
+		return "", err
+	}
+	if !indexed {
+		rowIDs = nil
+	}
+
+	return storage.ForEachProjected(s, owner, rowIDs, q.projection(), q.evaluator(env), page, fn)
+}
+
+func (q *Query) evaluator(env evalEnv) storage.RowEvaluator {
+	return func(row map[string]kvs.Entry) (bool, error) {
+		return q.evalRow(row, env)
+	}
+}
+
+// evalEnv is what evaluating a query's filters against a row needs besides
+// the row itself.
+type evalEnv struct {
+	fieldTypes map[string]reflect.Type
+	// members holds the rows each Has filter matches, by the filter's id.
+	members map[uint64]map[uint32]bool
+}
+
+// resolveEnv resolves the types of the fields q uses and looks up the rows
+// matching each of its Has filters.
+func resolveEnv[T storage.Value](s storage.Store, owner kvs.UUID, q *Query) (evalEnv, error) {
+	fieldTypes, err := resolveFieldTypes[T](q)
+	if err != nil {
+		return evalEnv{}, err
+	}
+	env := evalEnv{fieldTypes: fieldTypes, members: map[uint64]map[uint32]bool{}}
+	for _, f := range q.leafFilters() {
+		if f.op != has || env.members[f.id] != nil {
+			continue
+		}
+		if env.members[f.id], err = lookupMembers[T](s, owner, f, fieldTypes[f.fieldName]); err != nil {
+			return evalEnv{}, err
+		}
+	}
+	return env, nil
+}
+
+func resolveFieldTypes[T storage.Value](q *Query) (map[string]reflect.Type, error) {
+	fieldTypes := map[string]reflect.Type{}
+	if q == nil {
+		return fieldTypes, nil
+	}
+
+	v := *new(T)
+	expanded := map[string]bool{}
+	for _, c := range kvs.Columns(v) {
+		expanded[c.Name] = c.Expand
+	}
+	for _, filter := range q.leafFilters() {
+		fieldType, err := kvs.ColumnType(v, filter.fieldName)
+		if err != nil {
+			return nil, err
+		}
+		if filter.op == has && !expanded[filter.fieldName] {
+			return nil, fmt.Errorf("filter on field %s: has requires a column tagged with mdb:\"expand\"", filter.fieldName)
+		}
+		if filter.op != has && expanded[filter.fieldName] {
+			return nil, fmt.Errorf("cannot filter on expanded column %s, except with has", filter.fieldName)
+		}
+		if err := filter.validate(fieldType); err != nil {
+			return nil, err
+		}
+		fieldTypes[filter.fieldName] = fieldType
+	}
+
+	for _, o := range q.orderings {
+		fieldType, err := kvs.ColumnType(v, o.fieldName)
+		if err != nil {
+			return nil, err
+		}
+		if expanded[o.fieldName] || !kvs.OrderedBytesComparable(fieldType, fieldType) {
+			return nil, fmt.Errorf("%w: cannot order by column %s of type %s", kvs.ErrIncomparable, o.fieldName, fieldType)
+		}
+		fieldTypes[o.fieldName] = fieldType
+	}
+
+	return fieldTypes, nil
 }
 
 func (q *Query) Filter(fieldName string) *Filter {
 	q = q.clone()
-	filter := Filter{q: q, fieldName: fieldName}
+	filter := Filter{q: q, fieldName: strings.ToLower(fieldName)}
 	q.filters = append(q.filters, filter)
 	return &q.filters[len(q.filters)-1]
 }
 
+// Where adds conditions built with And, Or and Not, which rows have to
+// satisfy along with the query's filters.
+func (q *Query) Where(exprs ...Expr) *Query {
+	q = q.clone()
+	q.where = append(q.where, exprs...)
+	return q
+}
+
+// Select limits the columns loaded into the results to the given ones, the
+// other fields are left at their zero value. Columns the query filters on are
+// still read to evaluate it, but aren't loaded unless selected.
+func (q *Query) Select(columns ...string) *Query {
+	q = q.clone()
+	q.columns = nil
+	for _, c := range columns {
+		q.columns = append(q.columns, strings.ToLower(c))
+	}
+	return q
+}
+
+func (q *Query) projection() storage.Projection {
+	if q == nil || len(q.columns) == 0 {
+		return storage.Projection{}
+	}
+	read := []string{}
+	for _, f := range q.leafFilters() {
+		read = append(read, f.fieldName)
+	}
+	return storage.Projection{Columns: q.columns, Read: read}
+}
+
+// selects reports whether column is covered by the selected columns, which
+// includes the columns flattened from a selected struct field.
+func selects(columns []string, column string) bool {
+	for _, c := range columns {
+		if c == column || strings.HasPrefix(column, c+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// OrderBy sorts the results by the column's values, further calls order the
+// rows which all previous columns consider equal. Rows which are equal on
+// every column are ordered by their row ID.
+func (q *Query) OrderBy(fieldName string, dir Direction) *Query {
+	q = q.clone()
+	q.orderings = append(q.orderings, ordering{fieldName: strings.ToLower(fieldName), dir: dir})
+	return q
+}
+
+// HasPrefix matches string fields which start with any of the prefixes.
+func (f *Filter) HasPrefix(prefix ...string) *Query {
+	return f.textual(hasprefix, prefix)
+}
+
+// HasSuffix matches string fields which end with any of the suffixes.
+func (f *Filter) HasSuffix(suffix ...string) *Query {
+	return f.textual(hassuffix, suffix)
+}
+
+// Contains matches string fields which contain any of the substrings.
+func (f *Filter) Contains(substr ...string) *Query {
+	return f.textual(contains, substr)
+}
+
+// EqFold matches string fields equal to any of the values under Unicode case
+// folding.
+func (f *Filter) EqFold(value ...string) *Query {
+	return f.textual(equalfold, value)
+}
+
+// Matches matches string fields which any of the regular expressions match,
+// an invalid expression is reported when the query is run.
+func (f *Filter) Matches(pattern ...string) *Query {
+	f.op = matches
+	f.values = make([]any, 0, len(pattern))
+	for _, p := range pattern {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			f.err = err
+			return f.q
+		}
+		f.values = append(f.values, re)
+	}
+	return f.q
+}
+
+func (f *Filter) textual(op operator, values []string) *Query {
+	f.op = op
+	f.values = make([]any, 0, len(values))
+	for _, v := range values {
+		f.values = append(f.values, v)
+	}
+	return f.q
+}
+
+// Exists matches rows which have an entry stored for the field, whatever its
+// value. Rows saved before the field was added to the struct don't.
+func (f *Filter) Exists() *Query {
+	f.op = exists
+	f.values = nil
+	return f.q
+}
+
+// IsNull matches rows which have no entry stored for the field, or whose
+// stored value is a nil pointer, slice, map or interface. A zero value which
+// can't be nil, such as 0 or "", isn't null.
+func (f *Filter) IsNull() *Query {
+	f.op = isnull
+	f.values = nil
+	return f.q
+}
+
+var lastFilterID uint64
+
+// Has matches expanded slice columns holding any of the values as an element,
+// and expanded map columns holding any of them as a key. The rows matching it
+// are found from the stored elements before the query's rows are read.
+func (f *Filter) Has(value ...any) *Query {
+	f.op = has
+	f.values = value
+	f.id = atomic.AddUint64(&lastFilterID, 1)
+	return f.q
+}
+
+// Limit caps the number of rows returned, zero means no limit.
+func (q *Query) Limit(n int) *Query {
+	q = q.clone()
+	q.page.Limit = n
+	return q
+}
+
+// Offset skips the first n matching rows.
+func (q *Query) Offset(n int) *Query {
+	q = q.clone()
+	q.page.Offset = n
+	return q
+}
+
+// After resumes the query from a cursor returned by RunPage.
+func (q *Query) After(c storage.Cursor) *Query {
+	q = q.clone()
+	q.page.After = c
+	return q
+}
+
 func (f *Filter) Eq(value ...any) *Query {
 	f.values = value
 	f.op = equal
@@ -120,6 +608,31 @@ func (f *Filter) Lt(value ...any) *Query {
 	return f.q
 }
 
+func (f *Filter) Lte(value ...any) *Query {
+	f.values = value
+	f.op = lessthanorequal
+	return f.q
+}
+
+func (f *Filter) Gt(value ...any) *Query {
+	f.values = value
+	f.op = greaterthan
+	return f.q
+}
+
+func (f *Filter) Gte(value ...any) *Query {
+	f.values = value
+	f.op = greaterthanorequal
+	return f.q
+}
+
+// Between matches values within the inclusive range lower to upper.
+func (f *Filter) Between(lower, upper any) *Query {
+	f.values = []any{lower, upper}
+	f.op = between
+	return f.q
+}
+
 func (q *Query) clone() *Query {
 	x := *q
 	// Copy the contents of the slice-typed fields to a new backing store.
@@ -127,5 +640,17 @@ func (q *Query) clone() *Query {
 		x.filters = make([]Filter, len(q.filters))
 		copy(x.filters, q.filters)
 	}
+	if len(q.columns) > 0 {
+		x.columns = make([]string, len(q.columns))
+		copy(x.columns, q.columns)
+	}
+	if len(q.where) > 0 {
+		x.where = make([]Expr, len(q.where))
+		copy(x.where, q.where)
+	}
+	if len(q.orderings) > 0 {
+		x.orderings = make([]ordering, len(q.orderings))
+		copy(x.orderings, q.orderings)
+	}
 	return &x
 }
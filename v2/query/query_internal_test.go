@@ -66,3 +66,32 @@ func TestQueryFilterSubsequentOperatorAndValueOverwritesPrevious(t *testing.T) {
 	is.Equal(q.filters[0].op, equal)
 	is.Equal(q.filters[0].values, []any{"blue"})
 }
+
+func TestQueryRangeFiltersSetOperatorAndValues(t *testing.T) {
+	is := is.New(t)
+
+	is.Equal(New().Filter("size").Lt(10).filters[0].op, lessthan)
+	is.Equal(New().Filter("size").Lte(10).filters[0].op, lessthanorequal)
+	is.Equal(New().Filter("size").Gt(10).filters[0].op, greaterthan)
+	is.Equal(New().Filter("size").Gte(10).filters[0].op, greaterthanorequal)
+
+	q := New().Filter("size").Between(1, 5)
+	is.Equal(q.filters[0].op, between)
+	is.Equal(q.filters[0].values, []any{1, 5})
+	is.Equal(between.String(), "between")
+}
+
+func TestQueryTextualFiltersSetOperatorAndValues(t *testing.T) {
+	is := is.New(t)
+
+	is.Equal(New().Filter("name").HasPrefix("Ha").filters[0].op, hasprefix)
+	is.Equal(New().Filter("name").HasSuffix("x").filters[0].op, hassuffix)
+	is.Equal(New().Filter("name").Contains("a").filters[0].op, contains)
+	is.Equal(New().Filter("name").EqFold("HAX", "west").filters[0].values, []any{"HAX", "west"})
+	is.Equal(equalfold.String(), "equalfold")
+
+	q := New().Filter("name").Matches("^H")
+	is.Equal(q.filters[0].op, matches)
+	is.True(q.filters[0].err == nil)
+	is.True(New().Filter("name").Matches("(").filters[0].err != nil)
+}
@@ -32,8 +32,11 @@
 package query_test
 
 import (
+	"errors"
 	"testing"
+	"time"
 
+	"github.com/google/uuid"
 	"github.com/matryer/is"
 	"github.com/tauraamui/kvs/v2"
 	"github.com/tauraamui/kvs/v2/query"
@@ -228,3 +231,924 @@ func TestQueryFilterWithMultiplePredicateMultipleValuesFailure(t *testing.T) {
 	is.NoErr(err)
 	is.Equal(len(bs), 0)
 }
+
+type Flight struct {
+	ID       uint32 `mdb:"ignore"`
+	Pilot    string
+	Altitude int
+	Fare     float64
+	Seats    uint8
+	Departs  time.Time
+}
+
+func (f Flight) TableName() string { return "flights" }
+
+func saveFlights(is *is.I, store storage.Store, departs time.Time) {
+	is.NoErr(store.Save(kvs.RootOwner{}, &Flight{Pilot: "Alice", Altitude: 1200, Fare: 99.5, Seats: 4, Departs: departs}))
+	is.NoErr(store.Save(kvs.RootOwner{}, &Flight{Pilot: "Bob", Altitude: -30, Fare: 12.25, Seats: 2, Departs: departs.Add(time.Hour)}))
+	is.NoErr(store.Save(kvs.RootOwner{}, &Flight{Pilot: "Carol", Altitude: 800, Fare: 250, Seats: 9, Departs: departs.Add(2 * time.Hour)}))
+}
+
+func TestQueryFilterWithRangeOperatorsSuccess(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	departs := time.Date(2023, 4, 1, 9, 0, 0, 0, time.UTC)
+	saveFlights(is, store, departs)
+
+	pilots := func(fs []Flight) []string {
+		names := []string{}
+		for _, f := range fs {
+			names = append(names, f.Pilot)
+		}
+		return names
+	}
+
+	fs, err := query.Run[Flight](store, kvs.RootOwner{}, query.New().Filter("altitude").Lt(800))
+	is.NoErr(err)
+	is.Equal(pilots(fs), []string{"Bob"})
+
+	fs, err = query.Run[Flight](store, kvs.RootOwner{}, query.New().Filter("altitude").Lte(800))
+	is.NoErr(err)
+	is.Equal(pilots(fs), []string{"Bob", "Carol"})
+
+	fs, err = query.Run[Flight](store, kvs.RootOwner{}, query.New().Filter("fare").Gt(99.5))
+	is.NoErr(err)
+	is.Equal(pilots(fs), []string{"Carol"})
+
+	fs, err = query.Run[Flight](store, kvs.RootOwner{}, query.New().Filter("fare").Gte(99.5))
+	is.NoErr(err)
+	is.Equal(pilots(fs), []string{"Alice", "Carol"})
+
+	fs, err = query.Run[Flight](store, kvs.RootOwner{}, query.New().Filter("seats").Between(2, 4))
+	is.NoErr(err)
+	is.Equal(pilots(fs), []string{"Alice", "Bob"})
+
+	fs, err = query.Run[Flight](store, kvs.RootOwner{}, query.New().Filter("pilot").Gt("Alice"))
+	is.NoErr(err)
+	is.Equal(pilots(fs), []string{"Bob", "Carol"})
+
+	fs, err = query.Run[Flight](store, kvs.RootOwner{}, query.New().Filter("departs").Gt(departs.Add(30*time.Minute)).Filter("altitude").Gte(0))
+	is.NoErr(err)
+	is.Equal(pilots(fs), []string{"Carol"})
+}
+
+func TestQueryFilterWithRangeOperatorMismatchedTypeReturnsError(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	saveFlights(is, store, time.Now())
+
+	_, err = query.Run[Flight](store, kvs.RootOwner{}, query.New().Filter("altitude").Lt("high"))
+	is.True(errors.Is(err, kvs.ErrIncomparable))
+
+	_, err = query.Run[Flight](store, kvs.RootOwner{}, query.New().Filter("departs").Gt(10))
+	is.True(errors.Is(err, kvs.ErrIncomparable))
+
+	_, err = query.Run[Flight](store, kvs.RootOwner{}, query.New().Filter("wingspan").Gt(10))
+	is.True(err != nil) // unknown fields must be reported
+}
+
+func TestQueryFilterOnOrderedEncodingSuccess(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db, storage.WithCodec(kvs.OrderedCodec{}))
+	defer store.Close()
+
+	departs := time.Date(2023, 4, 1, 9, 0, 0, 0, time.UTC)
+	saveFlights(is, store, departs)
+
+	fs, err := query.Run[Flight](store, kvs.RootOwner{}, query.New().Filter("altitude").Between(-100, 1000))
+	is.NoErr(err)
+	is.Equal(len(fs), 2)
+	is.Equal(fs[0].Pilot, "Bob")
+	is.Equal(fs[1].Pilot, "Carol")
+
+	fs, err = query.Run[Flight](store, kvs.RootOwner{}, query.New().Filter("fare").Eq(250).Filter("departs").Eq(departs.Add(2*time.Hour)))
+	is.NoErr(err)
+	is.Equal(len(fs), 1)
+	is.Equal(fs[0].Pilot, "Carol")
+}
+
+type Passenger struct {
+	ID        uint32 `mdb:"ignore"`
+	FirstName string
+	Surname   string `mdb:"index"`
+	Age       int    `mdb:"index"`
+}
+
+func (p Passenger) TableName() string { return "passengers" }
+
+type UnindexedPassenger struct {
+	ID        uint32 `mdb:"ignore"`
+	FirstName string
+	Surname   string
+	Age       int
+}
+
+func (p UnindexedPassenger) TableName() string { return "passengers" }
+
+func savePassengers(is *is.I, store storage.Store) {
+	is.NoErr(store.Save(kvs.RootOwner{}, &Passenger{FirstName: "Brian", Surname: "Hax", Age: 3}))
+	is.NoErr(store.Save(kvs.RootOwner{}, &Passenger{FirstName: "Amy", Surname: "Hax", Age: 26}))
+	is.NoErr(store.Save(kvs.RootOwner{}, &Passenger{FirstName: "Mark", Surname: "West", Age: 58}))
+	is.NoErr(store.Save(kvs.RootOwner{}, &Passenger{FirstName: "Rory", Surname: "Hax", Age: 27}))
+}
+
+func firstNames(ps []Passenger) []string {
+	names := []string{}
+	for _, p := range ps {
+		names = append(names, p.FirstName)
+	}
+	return names
+}
+
+func TestQueryFilterUsingIndexesSuccess(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	savePassengers(is, store)
+
+	ps, err := query.Run[Passenger](store, kvs.RootOwner{}, query.New().Filter("surname").Eq("Hax"))
+	is.NoErr(err)
+	is.Equal(firstNames(ps), []string{"Brian", "Amy", "Rory"})
+
+	ps, err = query.Run[Passenger](store, kvs.RootOwner{}, query.New().Filter("surname").Eq("Hax").Filter("age").Gt(20))
+	is.NoErr(err)
+	is.Equal(firstNames(ps), []string{"Amy", "Rory"})
+
+	ps, err = query.Run[Passenger](store, kvs.RootOwner{}, query.New().Filter("age").Between(4, 58).Filter("firstname").Eq("Mark"))
+	is.NoErr(err)
+	is.Equal(firstNames(ps), []string{"Mark"})
+
+	ps, err = query.Run[Passenger](store, kvs.RootOwner{}, query.New().Filter("age").Lte(int8(26)))
+	is.NoErr(err)
+	is.Equal(firstNames(ps), []string{"Brian", "Amy"})
+
+	ps, err = query.Run[Passenger](store, kvs.RootOwner{}, query.New().Filter("surname").Eq("Nobody"))
+	is.NoErr(err)
+	is.Equal(len(ps), 0)
+}
+
+func TestQueryFilterUsingIndexesAfterUpdateAndDelete(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	savePassengers(is, store)
+
+	mark := Passenger{}
+	is.NoErr(storage.Load(store, &mark, kvs.RootOwner{}, 2))
+	mark.Surname = "Hax"
+	is.NoErr(store.Update(kvs.RootOwner{}, &mark, mark.ID))
+
+	brian := Passenger{}
+	is.NoErr(storage.Load(store, &brian, kvs.RootOwner{}, 0))
+	is.NoErr(store.Delete(kvs.RootOwner{}, &brian, brian.ID))
+
+	ps, err := query.Run[Passenger](store, kvs.RootOwner{}, query.New().Filter("surname").Eq("Hax"))
+	is.NoErr(err)
+	is.Equal(firstNames(ps), []string{"Amy", "Mark", "Rory"})
+
+	ps, err = query.Run[Passenger](store, kvs.RootOwner{}, query.New().Filter("surname").Eq("West"))
+	is.NoErr(err)
+	is.Equal(len(ps), 0)
+}
+
+func TestQueryReindexCoversRowsSavedBeforeIndexing(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	is.NoErr(store.Save(kvs.RootOwner{}, &UnindexedPassenger{FirstName: "Old", Surname: "Hax"}))
+	is.NoErr(store.Save(kvs.RootOwner{}, &Passenger{FirstName: "New", Surname: "Hax"}))
+
+	ps, err := query.Run[Passenger](store, kvs.RootOwner{}, query.New().Filter("surname").Eq("Hax"))
+	is.NoErr(err)
+	is.Equal(firstNames(ps), []string{"New"})
+
+	is.NoErr(storage.Reindex[Passenger](store, kvs.RootOwner{}))
+
+	ps, err = query.Run[Passenger](store, kvs.RootOwner{}, query.New().Filter("surname").Eq("Hax"))
+	is.NoErr(err)
+	is.Equal(firstNames(ps), []string{"Old", "New"})
+}
+
+type Audit struct {
+	CreatedBy string
+}
+
+type Address struct {
+	City    string `mdb:"index"`
+	Country string
+}
+
+type Customer struct {
+	ID uint32 `mdb:"ignore"`
+	Audit
+	Name    string
+	Address Address
+}
+
+func (c Customer) TableName() string { return "customers" }
+
+func TestQueryFilterOnFlattenedColumnsSuccess(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	is.NoErr(store.Save(kvs.RootOwner{}, &Customer{Audit: Audit{CreatedBy: "admin"}, Name: "Amy", Address: Address{City: "York", Country: "UK"}}))
+	is.NoErr(store.Save(kvs.RootOwner{}, &Customer{Audit: Audit{CreatedBy: "import"}, Name: "Bob", Address: Address{City: "Paris", Country: "FR"}}))
+	is.NoErr(store.Save(kvs.RootOwner{}, &Customer{Audit: Audit{CreatedBy: "admin"}, Name: "Cat", Address: Address{City: "Leeds", Country: "UK"}}))
+
+	cs, err := query.Run[Customer](store, kvs.RootOwner{}, query.New().Filter("address.country").Eq("UK").Filter("audit.createdby").Eq("admin"))
+	is.NoErr(err)
+	is.Equal(len(cs), 2)
+	is.Equal(cs[0], Customer{ID: 0, Audit: Audit{CreatedBy: "admin"}, Name: "Amy", Address: Address{City: "York", Country: "UK"}})
+	is.Equal(cs[1].Name, "Cat")
+
+	// address.city is indexed, so this is answered from the index
+	cs, err = query.Run[Customer](store, kvs.RootOwner{}, query.New().Filter("address.city").Eq("Paris"))
+	is.NoErr(err)
+	is.Equal(len(cs), 1)
+	is.Equal(cs[0].Name, "Bob")
+	is.Equal(cs[0].CreatedBy, "import")
+}
+
+func TestQueryPagination(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	savePassengers(is, store)
+
+	for _, tc := range []struct {
+		name  string
+		query *query.Query
+	}{
+		{name: "indexed", query: query.New().Filter("surname").Eq("Hax")},
+		{name: "unindexed", query: query.New().Filter("age").Gt(0)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			is := is.New(t)
+
+			q := tc.query.Limit(2)
+			first, cursor, err := query.RunPage[Passenger](store, kvs.RootOwner{}, q)
+			is.NoErr(err)
+			is.True(cursor != "")
+
+			rest, cursor, err := query.RunPage[Passenger](store, kvs.RootOwner{}, q.After(cursor))
+			is.NoErr(err)
+			is.Equal(cursor, storage.Cursor(""))
+
+			all, err := query.Run[Passenger](store, kvs.RootOwner{}, tc.query)
+			is.NoErr(err)
+			is.Equal(append(first, rest...), all)
+
+			skipped, err := query.Run[Passenger](store, kvs.RootOwner{}, tc.query.Offset(1).Limit(1))
+			is.NoErr(err)
+			is.Equal(skipped, all[1:2])
+		})
+	}
+}
+
+func runFirstNames[T storage.Value](is *is.I, store storage.Store, q *query.Query) ([]string, storage.Cursor) {
+	rows, cursor, err := query.RunPage[T](store, kvs.RootOwner{}, q)
+	is.NoErr(err)
+	names := []string{}
+	for _, r := range rows {
+		name, err := kvs.ColumnValue(r, "firstname")
+		is.NoErr(err)
+		names = append(names, name.(string))
+	}
+	return names, cursor
+}
+
+func TestQueryOrderBy(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	savePassengers(is, store)
+	is.NoErr(store.Save(kvs.RootOwner{}, &Passenger{FirstName: "Zoe", Surname: "West", Age: 3}))
+
+	for _, tc := range []struct {
+		name string
+		run  func(q *query.Query) ([]string, storage.Cursor)
+	}{
+		{name: "indexed", run: func(q *query.Query) ([]string, storage.Cursor) {
+			return runFirstNames[Passenger](is, store, q)
+		}},
+		{name: "unindexed", run: func(q *query.Query) ([]string, storage.Cursor) {
+			return runFirstNames[UnindexedPassenger](is, store, q)
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			is := is.New(t)
+
+			names, _ := tc.run(query.New().OrderBy("age", query.Desc))
+			is.Equal(names, []string{"Mark", "Rory", "Amy", "Brian", "Zoe"})
+
+			names, _ = tc.run(query.New().OrderBy("Surname", query.Asc).OrderBy("age", query.Desc))
+			is.Equal(names, []string{"Rory", "Amy", "Brian", "Mark", "Zoe"})
+
+			names, _ = tc.run(query.New().Filter("surname").Eq("Hax").OrderBy("age", query.Asc))
+			is.Equal(names, []string{"Brian", "Amy", "Rory"})
+
+			q := query.New().OrderBy("age", query.Asc).Limit(2)
+			names, cursor := tc.run(q)
+			is.Equal(names, []string{"Brian", "Zoe"})
+			names, cursor = tc.run(q.After(cursor))
+			is.Equal(names, []string{"Amy", "Rory"})
+			names, cursor = tc.run(q.After(cursor))
+			is.Equal(names, []string{"Mark"})
+			is.Equal(cursor, storage.Cursor(""))
+
+			names, _ = tc.run(query.New().OrderBy("age", query.Desc).Offset(1).Limit(3))
+			is.Equal(names, []string{"Rory", "Amy", "Brian"})
+		})
+	}
+
+	_, err = query.Run[Passenger](store, kvs.RootOwner{}, query.New().OrderBy("height", query.Asc))
+	is.True(err != nil)
+
+	_, err = query.Run[Passenger](store, kvs.RootOwner{}, query.New().OrderBy("age", query.Asc).After("MA"))
+	is.True(errors.Is(err, storage.ErrInvalidCursor))
+}
+
+func TestQueryBooleanExpressions(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	savePassengers(is, store)
+	is.NoErr(store.Save(kvs.RootOwner{}, &Passenger{FirstName: "Zoe", Surname: "West", Age: 3}))
+
+	hax := query.New().Filter("surname").Eq("Hax")
+	over50 := query.New().Filter("age").Gt(50)
+	under10 := query.New().Filter("age").Lt(10)
+
+	ps, err := query.Run[Passenger](store, kvs.RootOwner{}, query.New().Where(query.Or(hax, over50)))
+	is.NoErr(err)
+	is.Equal(firstNames(ps), []string{"Brian", "Amy", "Mark", "Rory"})
+
+	ps, err = query.Run[Passenger](store, kvs.RootOwner{}, query.New().Where(query.Not(hax)))
+	is.NoErr(err)
+	is.Equal(firstNames(ps), []string{"Mark", "Zoe"})
+
+	ps, err = query.Run[Passenger](store, kvs.RootOwner{}, hax.Where(query.Not(under10)))
+	is.NoErr(err)
+	is.Equal(firstNames(ps), []string{"Amy", "Rory"})
+
+	ps, err = query.Run[Passenger](store, kvs.RootOwner{}, query.New().Where(
+		query.Or(query.And(hax, under10), query.And(query.Not(hax), query.Not(under10))),
+	).OrderBy("age", query.Desc))
+	is.NoErr(err)
+	is.Equal(firstNames(ps), []string{"Mark", "Brian"})
+
+	_, err = query.Run[Passenger](store, kvs.RootOwner{}, query.New().Where(query.Or(hax, query.New().Filter("height").Gt(2))))
+	is.True(err != nil)
+}
+
+func TestQuerySelectLoadsOnlySelectedColumns(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	savePassengers(is, store)
+
+	ps, err := query.Run[Passenger](store, kvs.RootOwner{}, query.New().Select("firstname").Filter("age").Gt(20))
+	is.NoErr(err)
+	is.Equal(ps, []Passenger{{ID: 1, FirstName: "Amy"}, {ID: 2, FirstName: "Mark"}, {ID: 3, FirstName: "Rory"}})
+
+	ps, err = query.Run[Passenger](store, kvs.RootOwner{}, query.New().Select("firstname", "surname").OrderBy("age", query.Desc).Limit(2))
+	is.NoErr(err)
+	is.Equal(ps, []Passenger{{ID: 2, FirstName: "Mark", Surname: "West"}, {ID: 3, FirstName: "Rory", Surname: "Hax"}})
+
+	is.NoErr(store.Save(kvs.RootOwner{}, &Customer{Name: "Ada", Address: Address{City: "Leeds", Country: "UK"}}))
+	cs, err := query.Run[Customer](store, kvs.RootOwner{}, query.New().Select("address"))
+	is.NoErr(err)
+	is.Equal(cs, []Customer{{Address: Address{City: "Leeds", Country: "UK"}}})
+
+	_, err = query.Run[Passenger](store, kvs.RootOwner{}, query.New().Select("height"))
+	is.True(err != nil)
+}
+
+func TestQueryAggregates(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	savePassengers(is, store)
+
+	count, err := query.Count[Passenger](store, kvs.RootOwner{}, nil)
+	is.NoErr(err)
+	is.Equal(count, 4)
+
+	hax := query.New().Filter("surname").Eq("Hax")
+	count, err = query.Count[Passenger](store, kvs.RootOwner{}, hax)
+	is.NoErr(err)
+	is.Equal(count, 3)
+
+	count, err = query.Count[UnindexedPassenger](store, kvs.RootOwner{}, query.New().Where(query.Not(hax)))
+	is.NoErr(err)
+	is.Equal(count, 1)
+
+	sum, err := query.Sum[Passenger, int64](store, kvs.RootOwner{}, hax, "age")
+	is.NoErr(err)
+	is.Equal(sum, int64(56))
+
+	lowest, err := query.Min[UnindexedPassenger, int](store, kvs.RootOwner{}, nil, "Age")
+	is.NoErr(err)
+	is.Equal(lowest, 3)
+
+	highest, err := query.Max[Passenger, uint8](store, kvs.RootOwner{}, hax, "age")
+	is.NoErr(err)
+	is.Equal(highest, uint8(27))
+
+	avg, err := query.Avg[Passenger](store, kvs.RootOwner{}, query.New().Filter("age").Gt(20), "age")
+	is.NoErr(err)
+	is.Equal(avg, float64(26+58+27)/3)
+
+	_, err = query.Max[Passenger, int](store, kvs.RootOwner{}, query.New().Filter("surname").Eq("Nobody"), "age")
+	is.True(errors.Is(err, query.ErrNoRows))
+
+	_, err = query.Sum[Passenger, int](store, kvs.RootOwner{}, nil, "surname")
+	is.True(errors.Is(err, kvs.ErrIncomparable))
+}
+
+func TestQueryForEach(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	savePassengers(is, store)
+
+	names := []string{}
+	is.NoErr(query.ForEach(store, kvs.RootOwner{}, query.New().Filter("surname").Eq("Hax"), func(p Passenger) error {
+		names = append(names, p.FirstName)
+		return nil
+	}))
+	is.Equal(names, []string{"Brian", "Amy", "Rory"})
+
+	names = names[:0]
+	is.NoErr(query.ForEach(store, kvs.RootOwner{}, query.New().OrderBy("age", query.Desc), func(p Passenger) error {
+		names = append(names, p.FirstName)
+		if len(names) == 2 {
+			return storage.ErrStop
+		}
+		return nil
+	}))
+	is.Equal(names, []string{"Mark", "Rory"})
+
+	failure := errors.New("export failed")
+	is.Equal(query.ForEach(store, kvs.RootOwner{}, nil, func(p UnindexedPassenger) error { return failure }), failure)
+}
+
+func TestQueryParseAndRun(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	savePassengers(is, store)
+
+	for _, tc := range []struct {
+		src   string
+		names []string
+	}{
+		{src: ``, names: []string{"Brian", "Amy", "Mark", "Rory"}},
+		{src: `surname = "Hax" AND age < 27`, names: []string{"Brian", "Amy"}},
+		{src: `surname = "Hax" or AGE >= 58`, names: []string{"Brian", "Amy", "Mark", "Rory"}},
+		{src: `NOT (surname = "Hax" AND age > 10)`, names: []string{"Brian", "Mark"}},
+		{src: `surname != "Hax"`, names: []string{"Mark"}},
+		{src: `age between 20 and 30`, names: []string{"Amy", "Rory"}},
+		{src: `firstname in ("Amy", "Mark") and age <= 26.5`, names: []string{"Amy"}},
+		{src: `firstname not in ("Amy", "Mark")`, names: []string{"Brian", "Rory"}},
+	} {
+		q, err := query.ParseFor[Passenger](tc.src)
+		is.NoErr(err)
+		ps, err := query.Run[Passenger](store, kvs.RootOwner{}, q)
+		is.NoErr(err)
+		is.Equal(firstNames(ps), tc.names) // tc.src
+	}
+
+	q, err := query.ParseFor[Flight](`departs > "2023-01-01T00:00:00Z" and seats = 120`)
+	is.NoErr(err)
+	_, err = query.Run[Flight](store, kvs.RootOwner{}, q)
+	is.NoErr(err)
+}
+
+func TestQueryParseErrors(t *testing.T) {
+	is := is.New(t)
+
+	for _, tc := range []struct {
+		src string
+		pos int
+	}{
+		{src: `surname = "Hax`, pos: 10},
+		{src: `surname "Hax"`, pos: 8},
+		{src: `surname = "Hax" AND`, pos: 19},
+		{src: `(age > 3`, pos: 8},
+		{src: `age > 3 )`, pos: 8},
+		{src: `age ! 3`, pos: 4},
+		{src: `age between 1 or 3`, pos: 14},
+		{src: `age in (1 2)`, pos: 10},
+		{src: `age = #`, pos: 6},
+		{src: `and = 1`, pos: 0},
+	} {
+		_, err := query.Parse(tc.src)
+		var perr *query.ParseError
+		is.True(errors.As(err, &perr)) // tc.src
+		is.Equal(perr.Pos, tc.pos)     // tc.src
+	}
+
+	for _, tc := range []struct {
+		src string
+		pos int
+	}{
+		{src: `height > 2`, pos: 0},
+		{src: `age = "old"`, pos: 6},
+		{src: `surname = 3`, pos: 10},
+	} {
+		_, err := query.ParseFor[Passenger](tc.src)
+		var perr *query.ParseError
+		is.True(errors.As(err, &perr)) // tc.src
+		is.Equal(perr.Pos, tc.pos)     // tc.src
+	}
+
+	_, err := query.ParseFor[Flight](`departs > "yesterday"`)
+	is.True(err != nil)
+}
+
+func TestQueryStringMatchFilters(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	savePassengers(is, store)
+	is.NoErr(store.Save(kvs.RootOwner{}, &Passenger{FirstName: "Harry", Surname: "Haxby", Age: 40}))
+
+	for _, tc := range []struct {
+		name  string
+		query *query.Query
+		names []string
+	}{
+		{name: "indexed prefix", query: query.New().Filter("surname").HasPrefix("Hax"), names: []string{"Brian", "Amy", "Rory", "Harry"}},
+		{name: "unindexed prefix", query: query.New().Filter("firstname").HasPrefix("Ma", "Ro"), names: []string{"Mark", "Rory"}},
+		{name: "suffix", query: query.New().Filter("surname").HasSuffix("by"), names: []string{"Harry"}},
+		{name: "contains", query: query.New().Filter("firstname").Contains("r"), names: []string{"Brian", "Mark", "Rory", "Harry"}},
+		{name: "matches", query: query.New().Filter("firstname").Matches(`^[A-M]\w{3}$`), names: []string{"Mark"}},
+		{name: "eqfold", query: query.New().Filter("surname").EqFold("WEST"), names: []string{"Mark"}},
+	} {
+		ps, err := query.Run[Passenger](store, kvs.RootOwner{}, tc.query)
+		is.NoErr(err)
+		is.Equal(firstNames(ps), tc.names) // tc.name
+	}
+
+	q, err := query.ParseFor[Passenger](`surname hasprefix "Hax" and firstname matches "y$" and not (firstname eqfold "rory")`)
+	is.NoErr(err)
+	ps, err := query.Run[Passenger](store, kvs.RootOwner{}, q)
+	is.NoErr(err)
+	is.Equal(firstNames(ps), []string{"Amy", "Harry"})
+
+	_, err = query.Run[Passenger](store, kvs.RootOwner{}, query.New().Filter("age").Contains("2"))
+	is.True(errors.Is(err, kvs.ErrIncomparable))
+
+	_, err = query.Run[Passenger](store, kvs.RootOwner{}, query.New().Filter("firstname").Matches("("))
+	is.True(err != nil)
+
+	var perr *query.ParseError
+	_, err = query.Parse(`firstname matches "("`)
+	is.True(errors.As(err, &perr))
+	is.Equal(perr.Pos, 18)
+	_, err = query.Parse(`firstname contains 3`)
+	is.True(errors.As(err, &perr))
+	is.Equal(perr.Pos, 19)
+}
+
+// Traveller is Passenger after Nickname and Luggage were added, rows saved as
+// Passenger have no entries for them.
+type Traveller struct {
+	ID        uint32 `mdb:"ignore"`
+	FirstName string
+	Surname   string `mdb:"index"`
+	Age       int    `mdb:"index"`
+	Nickname  string
+	Luggage   *int
+}
+
+func (t Traveller) TableName() string { return "passengers" }
+
+func TestQueryExistsAndIsNull(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	savePassengers(is, store)
+	bags := 2
+	is.NoErr(store.Save(kvs.RootOwner{}, &Traveller{FirstName: "Zoe", Surname: "West", Nickname: "Z", Luggage: &bags}))
+	is.NoErr(store.Save(kvs.RootOwner{}, &Traveller{FirstName: "Yan", Surname: "Hax"}))
+
+	names := func(ts []Traveller) []string {
+		n := []string{}
+		for _, t := range ts {
+			n = append(n, t.FirstName)
+		}
+		return n
+	}
+
+	ts, err := query.Run[Traveller](store, kvs.RootOwner{}, query.New().Filter("nickname").Exists())
+	is.NoErr(err)
+	is.Equal(names(ts), []string{"Zoe", "Yan"})
+
+	ts, err = query.Run[Traveller](store, kvs.RootOwner{}, query.New().Filter("luggage").IsNull().Filter("surname").Eq("Hax"))
+	is.NoErr(err)
+	is.Equal(names(ts), []string{"Brian", "Amy", "Rory", "Yan"})
+
+	q, err := query.ParseFor[Traveller](`nickname is null or luggage is not null`)
+	is.NoErr(err)
+	ts, err = query.Run[Traveller](store, kvs.RootOwner{}, q.Select("firstname"))
+	is.NoErr(err)
+	is.Equal(names(ts), []string{"Brian", "Amy", "Mark", "Rory", "Zoe"})
+
+	count, err := query.Count[Traveller](store, kvs.RootOwner{}, query.New().Filter("nickname").IsNull())
+	is.NoErr(err)
+	is.Equal(count, 4)
+
+	// an empty string is a value, not null
+	count, err = query.Count[Traveller](store, kvs.RootOwner{}, query.New().Filter("nickname").Eq(""))
+	is.NoErr(err)
+	is.Equal(count, 1)
+}
+
+// Emailer is Passenger after Email was added as its first field.
+type Emailer struct {
+	ID        uint32 `mdb:"ignore"`
+	Email     string
+	FirstName string
+	Surname   string `mdb:"index"`
+	Age       int    `mdb:"index"`
+}
+
+func (e Emailer) TableName() string { return "passengers" }
+
+func TestQueryFindsRowsWithoutTheFirstColumn(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	savePassengers(is, store)
+	is.NoErr(store.Save(kvs.RootOwner{}, &Emailer{Email: "zoe@example.com", FirstName: "Zoe"}))
+
+	es, err := storage.LoadAllColumns[Emailer](store, kvs.RootOwner{}, "email")
+	is.NoErr(err)
+	is.Equal(len(es), 5)
+
+	noEmail := query.New().Filter("email").IsNull()
+	es, err = query.Run[Emailer](store, kvs.RootOwner{}, noEmail)
+	is.NoErr(err)
+	is.Equal(len(es), 4)
+
+	count, err := query.Count[Emailer](store, kvs.RootOwner{}, noEmail)
+	is.NoErr(err)
+	is.Equal(count, 4)
+
+	count, err = query.Count[Emailer](store, kvs.RootOwner{}, query.New().Filter("email").Exists())
+	is.NoErr(err)
+	is.Equal(count, 1)
+}
+
+func TestQueryRunWithinTx(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	savePassengers(is, store)
+	balloon := uuid.New()
+
+	// move the Wests to another balloon
+	is.NoErr(store.Tx(func(tx *storage.Tx) error {
+		wests, err := query.Run[Passenger](tx.Store, kvs.RootOwner{}, query.New().Filter("surname").Eq("West"))
+		if err != nil {
+			return err
+		}
+		for _, p := range wests {
+			if err := tx.Delete(kvs.RootOwner{}, &p, p.ID); err != nil {
+				return err
+			}
+			if err := tx.Save(balloon, &p); err != nil {
+				return err
+			}
+		}
+
+		wests, err = query.Run[Passenger](tx.Store, kvs.RootOwner{}, query.New().Filter("surname").Eq("West"))
+		is.NoErr(err)
+		is.Equal(len(wests), 0)
+		return nil
+	}))
+
+	ps, err := query.Run[Passenger](store, balloon, query.New().Filter("surname").Eq("West"))
+	is.NoErr(err)
+	is.Equal(firstNames(ps), []string{"Mark"})
+
+	ps, err = storage.LoadAll[Passenger](store, kvs.RootOwner{})
+	is.NoErr(err)
+	is.Equal(firstNames(ps), []string{"Brian", "Amy", "Rory"})
+}
+
+// CrewMember rows are only marked as deleted when deleted.
+type CrewMember struct {
+	ID      uint32 `mdb:"ignore"`
+	Name    string
+	Surname string `mdb:"index"`
+}
+
+func (c CrewMember) TableName() string { return "crew" }
+
+func (c CrewMember) SoftDelete() bool { return true }
+
+func TestQuerySkipsSoftDeletedRows(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	is.NoErr(store.Save(kvs.RootOwner{}, &CrewMember{Name: "Brian", Surname: "Hax"}))
+	is.NoErr(store.Save(kvs.RootOwner{}, &CrewMember{Name: "Amy", Surname: "Hax"}))
+	is.NoErr(store.Save(kvs.RootOwner{}, &CrewMember{Name: "Mark", Surname: "West"}))
+	is.NoErr(store.Delete(kvs.RootOwner{}, &CrewMember{}, 1))
+
+	// the surname filter is answered from its index
+	cs, err := query.Run[CrewMember](store, kvs.RootOwner{}, query.New().Filter("surname").Eq("Hax"))
+	is.NoErr(err)
+	is.Equal(cs, []CrewMember{{ID: 0, Name: "Brian", Surname: "Hax"}})
+
+	count, err := query.Count[CrewMember](store, kvs.RootOwner{}, query.New())
+	is.NoErr(err)
+	is.Equal(count, 2)
+
+	cs, err = query.Run[CrewMember](store, kvs.RootOwner{}, query.New().OrderBy("surname", query.Desc))
+	is.NoErr(err)
+	is.Equal(len(cs), 2)
+	is.Equal(cs[0].Name, "Mark")
+}
+
+type Article struct {
+	ID      uint32 `mdb:"ignore"`
+	Title   string
+	Tags    []string       `mdb:"expand"`
+	Ratings map[string]int `mdb:"expand"`
+}
+
+func (a Article) TableName() string { return "articles" }
+
+func articleTitles(as []Article) []string {
+	titles := []string{}
+	for _, a := range as {
+		titles = append(titles, a.Title)
+	}
+	return titles
+}
+
+func TestQueryHasMatchesExpandedElements(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	is.NoErr(store.Save(kvs.RootOwner{}, &Article{Title: "Badger", Tags: []string{"go", "db"}, Ratings: map[string]int{"amy": 4}}))
+	is.NoErr(store.Save(kvs.RootOwner{}, &Article{Title: "Gophers", Tags: []string{"go"}, Ratings: map[string]int{"brian": 2}}))
+	is.NoErr(store.Save(kvs.RootOwner{}, &Article{Title: "Pasta", Tags: []string{"food"}}))
+	is.NoErr(storage.AppendElements[Article](store, kvs.RootOwner{}, 2, "tags", "db"))
+
+	as, err := query.Run[Article](store, kvs.RootOwner{}, query.New().Filter("tags").Has("db"))
+	is.NoErr(err)
+	is.Equal(articleTitles(as), []string{"Badger", "Pasta"})
+	is.Equal(as[0].Tags, []string{"go", "db"}) // matching rows still load every element
+
+	as, err = query.Run[Article](store, kvs.RootOwner{}, query.New().Filter("ratings").Has("brian", "carl"))
+	is.NoErr(err)
+	is.Equal(articleTitles(as), []string{"Gophers"})
+
+	as, err = query.Run[Article](store, kvs.RootOwner{}, query.New().Where(query.Or(
+		query.Not(query.New().Filter("tags").Has("go")),
+		query.New().Filter("ratings").Has("amy"),
+	)))
+	is.NoErr(err)
+	is.Equal(articleTitles(as), []string{"Badger", "Pasta"})
+
+	q, err := query.ParseFor[Article](`tags HAS ("food", "none") OR title = "Gophers"`)
+	is.NoErr(err)
+	as, err = query.Run[Article](store, kvs.RootOwner{}, q)
+	is.NoErr(err)
+	is.Equal(articleTitles(as), []string{"Gophers", "Pasta"})
+
+	n, err := query.Count[Article](store, kvs.RootOwner{}, query.New().Filter("tags").Has("go"))
+	is.NoErr(err)
+	is.Equal(n, 2)
+
+	_, err = query.Run[Article](store, kvs.RootOwner{}, query.New().Filter("title").Has("Pasta"))
+	is.True(err != nil) // only expanded columns have elements
+	_, err = query.Run[Article](store, kvs.RootOwner{}, query.New().Filter("tags").Eq("go"))
+	is.True(err != nil)
+}
@@ -0,0 +1,339 @@
+// Copyright (c) 2023 Adam Prakash Stringer
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted (subject to the limitations in the disclaimer
+// below) provided that the following conditions are met:
+//
+//     * Redistributions of source code must retain the above copyright notice,
+//     this list of conditions and the following disclaimer.
+//
+//     * Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+//     * Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from this
+//     software without specific prior written permission.
+//
+// NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+// THIS LICENSE. THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR
+// BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER
+// IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strconv"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/tauraamui/kvs/v2"
+)
+
+// Every table and column an owner has stored rows under is recorded with a key
+// of its own, so the rows a UUID owns can be found without knowing the types
+// they were saved as.
+//
+// _own.OWNERUUID.TABLE_NAME.COLUMN_NAME
+//
+// Saves only write the keys which are missing, so once a table's keys are
+// recorded saves only read them, and only saves racing to record the same
+// keys can conflict on them. Rows saved before the registry existed are only found once they
+// have been saved again, or once BackfillOwnership has recorded their table.
+const ownedKeyPrefix = "_own"
+
+// identityColumn holds the UUID a row owns other rows by, it is the column of
+// a struct field named UUID.
+const identityColumn = "uuid"
+
+var uuidType = reflect.TypeOf((*kvs.UUID)(nil)).Elem()
+
+func ownedPrefix(owner kvs.UUID) []byte {
+	return []byte(fmt.Sprintf("%s.%s.", ownedKeyPrefix, ownerID(owner)))
+}
+
+func ownedKey(owner string, tableName, column string) []byte {
+	return []byte(fmt.Sprintf("%s.%s.%s.%s", ownedKeyPrefix, owner, tableName, column))
+}
+
+// writeOwnership records the columns of v which aren't yet recorded for
+// owner.
+func writeOwnership(txn *badger.Txn, owner kvs.UUID, v Value) error {
+	recorded := map[string]bool{}
+	prefix := append(ownedPrefix(owner), v.TableName()+"."...)
+	if err := eachKey(txn, prefix, func(key []byte) error {
+		recorded[string(key[len(prefix):])] = true
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	for _, c := range kvs.Columns(v) {
+		if recorded[c.Name] {
+			continue
+		}
+		if err := txn.Set(ownedKey(ownerID(owner), v.TableName(), c.Name), nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BackfillOwnership records every owner T's table has rows stored under, so
+// that DeleteOwned and DeleteCascade also find the rows saved before the
+// ownership registry existed. Like Reindex it only has to be run once.
+func BackfillOwnership[T Value](s Store) error {
+	v := *new(T)
+	columns := []string{}
+	for _, c := range kvs.Columns(v) {
+		columns = append(columns, c.Name)
+	}
+	for _, ent := range kvs.ConvertToLegacyEntries(v.TableName(), nil, 0, v) {
+		columns = append(columns, ent.ColumnName)
+	}
+
+	return s.update(func(txn *badger.Txn) error {
+		owned := map[string]bool{}
+		for _, column := range columns {
+			prefix := []byte(fmt.Sprintf("%s.%s.", v.TableName(), column))
+			if err := eachKey(txn, prefix, func(key []byte) error {
+				// the rest is OWNERUUID.ROW_ID, unless the key belongs to a
+				// column flattened out of this one
+				rest := key[len(prefix):]
+				if bytes.Count(rest, []byte(".")) != 1 {
+					return nil
+				}
+				owner, _, _ := bytes.Cut(rest, []byte("."))
+				owned[string(ownedKey(string(owner), v.TableName(), column))] = true
+				return nil
+			}); err != nil {
+				return err
+			}
+		}
+		for key := range owned {
+			if err := txn.Set([]byte(key), nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// CascadeReport counts the rows a cascading delete removed from each table.
+type CascadeReport struct {
+	Rows map[string]int
+}
+
+// DeleteCascade deletes the given row as Purge does, after deleting every
+// row owned by the UUID stored in its UUID field, the rows those own in turn
+// and so on. The owned rows are deleted in batches of transactions rather than
+// one, so a failed cascade can leave some of them behind, running it again
+// carries on where it stopped.
+func (s Store) DeleteCascade(owner kvs.UUID, value Value, rowID uint32) (CascadeReport, error) {
+	report := CascadeReport{Rows: map[string]int{}}
+
+	var id kvs.UUID
+	found := false
+	if err := s.view(func(txn *badger.Txn) error {
+		blankEntries := kvs.ConvertToBlankEntries(value.TableName(), owner, rowID, value)
+		// a soft deleted row still owns its rows, which go along with it
+		_, entries, ok, err := newListedRows(txn, []uint32{rowID}, blankEntries, nil, map[string]bool{identityColumn: true}, allRows).next()
+		if err != nil || !ok {
+			return err
+		}
+		found = true
+		for _, ent := range entries {
+			if ent.ColumnName != identityColumn {
+				continue
+			}
+			stored, err := kvs.DecodeBytes(ent.Data, kvs.Encoding(ent.Meta), uuidType)
+			if err != nil {
+				return err
+			}
+			id, _ = stored.(kvs.UUID)
+		}
+		return nil
+	}); err != nil {
+		return report, err
+	}
+
+	if id != nil {
+		owned, err := s.DeleteOwned(id)
+		if err != nil {
+			return owned, err
+		}
+		report = owned
+	}
+
+	if err := s.Purge(owner, value, rowID); err != nil {
+		return report, err
+	}
+	if found {
+		report.Rows[value.TableName()]++
+	}
+	return report, nil
+}
+
+// DeleteOwned deletes every row owner has stored in any table, along with
+// the rows each of them owns through its UUID field, recursively. Rows are
+// found through the ownership registry, so their types need not be known.
+func (s Store) DeleteOwned(owner kvs.UUID) (CascadeReport, error) {
+	report := CascadeReport{Rows: map[string]int{}}
+
+	wb := s.newDeleter()
+	defer wb.Cancel()
+
+	if err := s.deleteOwned(wb, owner, map[string]bool{}, report); err != nil {
+		return report, err
+	}
+	return report, wb.Flush()
+}
+
+func (s Store) deleteOwned(wb deleter, owner kvs.UUID, visited map[string]bool, report CascadeReport) error {
+	if visited[ownerID(owner)] {
+		return nil
+	}
+	visited[ownerID(owner)] = true
+
+	tables := map[string][]string{}
+	order := []string{}
+	children := []kvs.UUID{}
+	if err := s.view(func(txn *badger.Txn) error {
+		prefix := ownedPrefix(owner)
+		err := eachKey(txn, prefix, func(key []byte) error {
+			table, column, ok := bytes.Cut(key[len(prefix):], []byte("."))
+			if !ok {
+				return nil
+			}
+			if _, seen := tables[string(table)]; !seen {
+				order = append(order, string(table))
+			}
+			tables[string(table)] = append(tables[string(table)], string(column))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, table := range order {
+			ent := kvs.Entry{TableName: table, ColumnName: identityColumn, OwnerUUID: owner}
+			idPrefix := append(ent.PrefixKey(), '.')
+			it := txn.NewIterator(badger.DefaultIteratorOptions)
+			for it.Seek(idPrefix); it.ValidForPrefix(idPrefix); it.Next() {
+				if err := loadItemDataIntoEntry(&ent, it.Item().Value); err != nil {
+					it.Close()
+					return err
+				}
+				stored, err := kvs.DecodeBytes(ent.Data, kvs.Encoding(it.Item().UserMeta()), uuidType)
+				if err != nil {
+					it.Close()
+					return err
+				}
+				if id, ok := stored.(kvs.UUID); ok && id != nil {
+					children = append(children, id)
+				}
+			}
+			it.Close()
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	// children go first, so that an interrupted cascade can be run again
+	// from the same row
+	for _, child := range children {
+		if err := s.deleteOwned(wb, child, visited, report); err != nil {
+			return err
+		}
+	}
+
+	return s.view(func(txn *badger.Txn) error {
+		for _, table := range order {
+			rows := map[uint32]bool{}
+			for _, column := range tables[table] {
+				ent := kvs.Entry{TableName: table, ColumnName: column, OwnerUUID: owner}
+				prefix := append(ent.PrefixKey(), '.')
+				if err := eachKey(txn, prefix, func(key []byte) error {
+					rowID, err := strconv.ParseUint(string(key[len(prefix):]), 10, 32)
+					if err != nil {
+						return err
+					}
+					rows[uint32(rowID)] = true
+					return wb.Delete(key)
+				}); err != nil {
+					return err
+				}
+			}
+			report.Rows[table] += len(rows)
+			for row := range rows {
+				if s.changes {
+					if err := wb.SetEntry(changeEntry(table, owner, row, Deleted)); err != nil {
+						return err
+					}
+				}
+				if s.revisions {
+					if err := wb.SetEntry(removedRevision(table, owner, row)); err != nil {
+						return err
+					}
+				}
+			}
+
+			for _, prefix := range []string{indexKeyPrefix, elementKeyPrefix, uniqueKeyPrefix, tombstoneKeyPrefix} {
+				if err := eachKey(txn, []byte(fmt.Sprintf("%s.%s.%s.", prefix, table, ownerID(owner))), wb.Delete); err != nil {
+					return err
+				}
+			}
+			// the row ID sequence is kept, so the IDs of the deleted rows are
+			// never handed out again
+			if err := deleteGlobalClaims(txn, wb, table, owner); err != nil {
+				return err
+			}
+		}
+		return eachKey(txn, ownedPrefix(owner), wb.Delete)
+	})
+}
+
+// deleteGlobalClaims releases the global unique claims held by rows of owner.
+func deleteGlobalClaims(txn *badger.Txn, wb deleter, table string, owner kvs.UUID) error {
+	prefix := []byte(fmt.Sprintf("%s.%s.%s.", uniqueKeyPrefix, table, globalUniqueScope))
+	it := txn.NewIterator(badger.IteratorOptions{Prefix: prefix})
+	defer it.Close()
+	for it.Rewind(); it.Valid(); it.Next() {
+		claim, err := it.Item().ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		if len(claim) > 4 && string(claim[4:]) == ownerID(owner) {
+			if err := wb.Delete(it.Item().KeyCopy(nil)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// eachKey hands a copy of every key under prefix to fn.
+func eachKey(txn *badger.Txn, prefix []byte, fn func(key []byte) error) error {
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	it := txn.NewIterator(opts)
+	defer it.Close()
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		if err := fn(it.Item().KeyCopy(nil)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
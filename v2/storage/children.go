@@ -0,0 +1,111 @@
+// Copyright (c) 2023 Adam Prakash Stringer
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted (subject to the limitations in the disclaimer
+// below) provided that the following conditions are met:
+//
+//     * Redistributions of source code must retain the above copyright notice,
+//     this list of conditions and the following disclaimer.
+//
+//     * Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+//     * Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from this
+//     software without specific prior written permission.
+//
+// NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+// THIS LICENSE. THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR
+// BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER
+// IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package storage
+
+import (
+	"github.com/dgraph-io/badger/v3"
+	"github.com/tauraamui/kvs/v2"
+)
+
+// Group is a parent row together with the rows it owns.
+type Group[P, C any] struct {
+	Parent   P
+	Children []C
+}
+
+// Loader loads the rows of a single owner, it is built with Rows and
+// WithChildren and run with LoadWith.
+type Loader[T any] struct {
+	load func(txn *badger.Txn, owner kvs.UUID) ([]T, error)
+}
+
+// Rows loads every row of T, the same rows LoadAll returns.
+func Rows[T Value]() Loader[T] {
+	return Loader[T]{load: func(txn *badger.Txn, owner kvs.UUID) ([]T, error) {
+		blankEntries := kvs.ConvertToBlankEntries((*new(T)).TableName(), owner, 0, *new(T))
+		dest := []T{}
+		_, err := eachRow(txn, owner, newMergedRows(txn, blankEntries, nil, nil, liveRowsOf(*new(T))), nil, Page{}, nil, func(row T) (bool, error) {
+			dest = append(dest, row)
+			return true, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		return dest, nil
+	}}
+}
+
+// WithChildren loads every row of P and groups it with the rows children loads
+// for the owner key returns, rows for which key returns nil have no children.
+// Passing another WithChildren loader as children loads further levels.
+func WithChildren[P Value, C any](key func(parent P) kvs.UUID, children Loader[C]) Loader[Group[P, C]] {
+	parents := Rows[P]()
+	return Loader[Group[P, C]]{load: func(txn *badger.Txn, owner kvs.UUID) ([]Group[P, C], error) {
+		ps, err := parents.load(txn, owner)
+		if err != nil {
+			return nil, err
+		}
+
+		groups := make([]Group[P, C], 0, len(ps))
+		for _, p := range ps {
+			group := Group[P, C]{Parent: p, Children: []C{}}
+			if childOwner := key(p); childOwner != nil {
+				if group.Children, err = children.load(txn, childOwner); err != nil {
+					return nil, err
+				}
+			}
+			groups = append(groups, group)
+		}
+		return groups, nil
+	}}
+}
+
+// LoadWith runs l against the rows of owner within a single read transaction,
+// so every level sees the store as it was when the load started.
+func LoadWith[T any](s Store, owner kvs.UUID, l Loader[T]) ([]T, error) {
+	var dest []T
+	err := s.view(func(txn *badger.Txn) error {
+		var err error
+		dest, err = l.load(txn, owner)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return dest, nil
+}
+
+// LoadWithChildren loads every row of P owned by owner grouped with the rows
+// of C owned by the UUID key returns for it, in one read transaction.
+func LoadWithChildren[P Value, C Value](s Store, owner kvs.UUID, key func(parent P) kvs.UUID) ([]Group[P, C], error) {
+	return LoadWith(s, owner, WithChildren(key, Rows[C]()))
+}
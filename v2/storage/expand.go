@@ -0,0 +1,497 @@
+// Copyright (c) 2023 Adam Prakash Stringer
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted (subject to the limitations in the disclaimer
+// below) provided that the following conditions are met:
+//
+//     * Redistributions of source code must retain the above copyright notice,
+//     this list of conditions and the following disclaimer.
+//
+//     * Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+//     * Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from this
+//     software without specific prior written permission.
+//
+// NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+// THIS LICENSE. THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR
+// BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER
+// IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/tauraamui/kvs/v2"
+)
+
+// Slice and map columns tagged with mdb:"expand" store each element under a
+// key of its own, while the column's regular key only holds an empty header.
+// Slice elements are keyed by their big endian position, map elements by
+// their key in kvs.OrderedEncoding, so both load back in order.
+//
+// _elem.TABLE_NAME.OWNERUUID.ROW_ID.COLUMN_NAME.<position|key>
+//
+// Keeping every element of a row under the same prefix means deleting the
+// row can clear them all in one sweep.
+const elementKeyPrefix = "_elem"
+
+func elementRowPrefix(tableName string, owner kvs.UUID, rowID uint32) []byte {
+	return []byte(fmt.Sprintf("%s.%s.%s.%d.", elementKeyPrefix, tableName, ownerID(owner), rowID))
+}
+
+func elementPrefix(tableName string, owner kvs.UUID, rowID uint32, column string) []byte {
+	return append(elementRowPrefix(tableName, owner, rowID), column+"."...)
+}
+
+func expandedColumns(v any) []kvs.Column {
+	expanded := []kvs.Column{}
+	for _, c := range kvs.Columns(v) {
+		if c.Expand {
+			expanded = append(expanded, c)
+		}
+	}
+	return expanded
+}
+
+func expandedColumn(v any, name string) (kvs.Column, error) {
+	for _, c := range kvs.Columns(v) {
+		if c.Name != strings.ToLower(name) {
+			continue
+		}
+		if !c.Expand {
+			return kvs.Column{}, fmt.Errorf("column %s is not tagged with mdb:\"expand\"", c.Name)
+		}
+		return c, nil
+	}
+	return kvs.Column{}, fmt.Errorf("column %s not found", name)
+}
+
+func setElement(txn *badger.Txn, key []byte, value any, c kvs.Codec, expiresAt uint64) error {
+	data, meta, err := kvs.EncodeValue(value, c)
+	if err != nil {
+		return err
+	}
+	e := badger.NewEntry(key, data).WithMeta(meta)
+	e.ExpiresAt = expiresAt
+	return txn.SetEntry(e)
+}
+
+func deletePrefix(txn *badger.Txn, prefix []byte) error {
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	it := txn.NewIterator(opts)
+
+	keys := [][]byte{}
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		keys = append(keys, it.Item().KeyCopy(nil))
+	}
+	it.Close()
+
+	for _, k := range keys {
+		if err := txn.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeElements replaces the stored elements of each of v's expanded columns.
+func writeElements(txn *badger.Txn, owner kvs.UUID, rowID uint32, v Value, c kvs.Codec, expiresAt uint64) error {
+	for _, column := range expandedColumns(v) {
+		prefix := elementPrefix(v.TableName(), owner, rowID, column.Name)
+		if err := deletePrefix(txn, prefix); err != nil {
+			return err
+		}
+
+		current, err := kvs.ColumnValue(v, column.Name)
+		if err != nil {
+			return err
+		}
+		rv := reflect.ValueOf(current)
+
+		switch rv.Kind() {
+		case reflect.Slice:
+			for i := 0; i < rv.Len(); i++ {
+				key := binary.BigEndian.AppendUint64(append([]byte{}, prefix...), uint64(i))
+				if err := setElement(txn, key, rv.Index(i).Interface(), c, expiresAt); err != nil {
+					return err
+				}
+			}
+		case reflect.Map:
+			iter := rv.MapRange()
+			for iter.Next() {
+				k, err := kvs.EncodeOrdered(iter.Key().Interface())
+				if err != nil {
+					return err
+				}
+				if err := setElement(txn, append(append([]byte{}, prefix...), k...), iter.Value().Interface(), c, expiresAt); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func deleteElements(txn *badger.Txn, owner kvs.UUID, rowID uint32, v Value) error {
+	if len(expandedColumns(v)) == 0 {
+		return nil
+	}
+	return deletePrefix(txn, elementRowPrefix(v.TableName(), owner, rowID))
+}
+
+// loadElements fills each of dest's expanded columns from their stored
+// elements, dest must be a pointer. Only the columns in load are filled,
+// unless it is nil.
+func loadElements(txn *badger.Txn, tableName string, owner kvs.UUID, rowID uint32, dest any, load map[string]bool) error {
+	for _, column := range expandedColumns(dest) {
+		if load != nil && !load[column.Name] {
+			continue
+		}
+		prefix := elementPrefix(tableName, owner, rowID, column.Name)
+
+		elems := []storedElement{}
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+			ent := kvs.Entry{}
+			if err := loadItemDataIntoEntry(&ent, item.Value); err != nil {
+				it.Close()
+				return err
+			}
+			elems = append(elems, storedElement{key: item.KeyCopy(nil)[len(prefix):], data: ent.Data, meta: item.UserMeta()})
+		}
+		it.Close()
+
+		if err := setElements(dest, column, elems); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// storedElement is an element of an expanded column as it is stored, key
+// being what follows the column's element prefix.
+type storedElement struct {
+	key  []byte
+	data []byte
+	meta byte
+}
+
+// setElements decodes elems into the expanded column of dest, in the order
+// they are given.
+func setElements(dest any, column kvs.Column, elems []storedElement) error {
+	elemType := column.Type.Elem()
+	collection := reflect.Zero(column.Type)
+	for _, e := range elems {
+		elem, err := kvs.DecodeBytes(e.data, kvs.Encoding(e.meta), elemType)
+		if err != nil {
+			return fmt.Errorf("failed to decode element of column %s: %w", column.Name, err)
+		}
+
+		if column.Type.Kind() == reflect.Slice {
+			collection = reflect.Append(collection, reflect.ValueOf(elem))
+			continue
+		}
+
+		key, err := kvs.DecodeBytes(e.key, kvs.OrderedEncoding, column.Type.Key())
+		if err != nil {
+			return fmt.Errorf("failed to decode element key of column %s: %w", column.Name, err)
+		}
+		if collection.IsNil() {
+			collection = reflect.MakeMap(column.Type)
+		}
+		collection.SetMapIndex(reflect.ValueOf(key), reflect.ValueOf(elem))
+	}
+
+	return kvs.SetColumnValue(dest, column.Name, collection.Interface())
+}
+
+// rowHeaderExpiry checks the row has a header for the expanded column,
+// returning when it expires so that new elements expire along with it.
+func rowHeaderExpiry(txn *badger.Txn, tableName string, owner kvs.UUID, rowID uint32, column kvs.Column) (uint64, error) {
+	ent := kvs.Entry{TableName: tableName, ColumnName: column.Name, OwnerUUID: owner, RowID: rowID}
+	item, err := txn.Get(ent.Key())
+	if err != nil {
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return 0, fmt.Errorf("%w: row %d of %s", ErrRowNotFound, rowID, tableName)
+		}
+		return 0, err
+	}
+	return item.ExpiresAt(), nil
+}
+
+func elementValue(v any, t reflect.Type) (any, error) {
+	if v != nil && reflect.TypeOf(v).AssignableTo(t) {
+		return v, nil
+	}
+	if converted, ok := kvs.ConvertLossless(v, t); ok {
+		return converted, nil
+	}
+	return nil, fmt.Errorf("cannot use %v (%T) as %s", v, v, t)
+}
+
+// AppendElements appends elems to the expanded slice column of the given row,
+// without reading or rewriting the elements already stored.
+func AppendElements[T Value](s Store, owner kvs.UUID, rowID uint32, column string, elems ...any) error {
+	v := *new(T)
+	col, err := expandedColumn(v, column)
+	if err != nil {
+		return err
+	}
+	if col.Type.Kind() != reflect.Slice {
+		return fmt.Errorf("column %s is not a slice", col.Name)
+	}
+
+	values := make([]any, 0, len(elems))
+	for _, e := range elems {
+		value, err := elementValue(e, col.Type.Elem())
+		if err != nil {
+			return err
+		}
+		values = append(values, value)
+	}
+
+	codec, err := s.codecFor(v)
+	if err != nil {
+		return err
+	}
+
+	prefix := elementPrefix(v.TableName(), owner, rowID, col.Name)
+	return s.update(func(txn *badger.Txn) error {
+		expiresAt, err := rowHeaderExpiry(txn, v.TableName(), owner, rowID, col)
+		if err != nil {
+			return err
+		}
+
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Reverse = true
+		it := txn.NewIterator(opts)
+		var next uint64
+		if it.Seek(append(append([]byte{}, prefix...), 0xFF)); it.ValidForPrefix(prefix) {
+			next = binary.BigEndian.Uint64(it.Item().Key()[len(prefix):]) + 1
+		}
+		it.Close()
+
+		for i, value := range values {
+			key := binary.BigEndian.AppendUint64(append([]byte{}, prefix...), next+uint64(i))
+			if err := setElement(txn, key, value, codec, expiresAt); err != nil {
+				return err
+			}
+		}
+		if err := s.writeRevision(txn, v.TableName(), owner, rowID, expiresAt); err != nil {
+			return err
+		}
+		return s.writeChange(txn, v.TableName(), owner, rowID, Updated)
+	})
+}
+
+// SetElement stores value under key in the expanded map column of the given
+// row, replacing the element already stored under that key if there is one.
+func SetElement[T Value](s Store, owner kvs.UUID, rowID uint32, column string, key, value any) error {
+	v := *new(T)
+	col, err := expandedColumn(v, column)
+	if err != nil {
+		return err
+	}
+	if col.Type.Kind() != reflect.Map {
+		return fmt.Errorf("column %s is not a map", col.Name)
+	}
+
+	k, err := elementValue(key, col.Type.Key())
+	if err != nil {
+		return err
+	}
+	encodedKey, err := kvs.EncodeOrdered(k)
+	if err != nil {
+		return err
+	}
+	value, err = elementValue(value, col.Type.Elem())
+	if err != nil {
+		return err
+	}
+
+	codec, err := s.codecFor(v)
+	if err != nil {
+		return err
+	}
+
+	prefix := elementPrefix(v.TableName(), owner, rowID, col.Name)
+	return s.update(func(txn *badger.Txn) error {
+		expiresAt, err := rowHeaderExpiry(txn, v.TableName(), owner, rowID, col)
+		if err != nil {
+			return err
+		}
+		if err := setElement(txn, append(prefix, encodedKey...), value, codec, expiresAt); err != nil {
+			return err
+		}
+		if err := s.writeRevision(txn, v.TableName(), owner, rowID, expiresAt); err != nil {
+			return err
+		}
+		return s.writeChange(txn, v.TableName(), owner, rowID, Updated)
+	})
+}
+
+// RemoveElements removes elements from an expanded column of the given row,
+// for slices every element equal to one of elems is removed and for maps elems
+// are the keys to remove. It returns how many elements were removed.
+func RemoveElements[T Value](s Store, owner kvs.UUID, rowID uint32, column string, elems ...any) (int, error) {
+	v := *new(T)
+	col, err := expandedColumn(v, column)
+	if err != nil {
+		return 0, err
+	}
+
+	matchType := col.Type.Elem()
+	if col.Type.Kind() == reflect.Map {
+		matchType = col.Type.Key()
+	}
+	values := make([]any, 0, len(elems))
+	for _, e := range elems {
+		value, err := elementValue(e, matchType)
+		if err != nil {
+			return 0, err
+		}
+		values = append(values, value)
+	}
+
+	prefix := elementPrefix(v.TableName(), owner, rowID, col.Name)
+	removed := 0
+	err = s.update(func(txn *badger.Txn) error {
+		keys := [][]byte{}
+		if col.Type.Kind() == reflect.Map {
+			for _, value := range values {
+				k, err := kvs.EncodeOrdered(value)
+				if err != nil {
+					return err
+				}
+				key := append(append([]byte{}, prefix...), k...)
+				if _, err := txn.Get(key); err != nil {
+					if errors.Is(err, badger.ErrKeyNotFound) {
+						continue
+					}
+					return err
+				}
+				keys = append(keys, key)
+			}
+		} else {
+			it := txn.NewIterator(badger.DefaultIteratorOptions)
+			for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+				item := it.Item()
+				ent := kvs.Entry{}
+				if err := loadItemDataIntoEntry(&ent, item.Value); err != nil {
+					it.Close()
+					return err
+				}
+				elem, err := kvs.DecodeBytes(ent.Data, kvs.Encoding(item.UserMeta()), matchType)
+				if err != nil {
+					it.Close()
+					return err
+				}
+				for _, value := range values {
+					if reflect.DeepEqual(elem, value) {
+						keys = append(keys, item.KeyCopy(nil))
+						break
+					}
+				}
+			}
+			it.Close()
+		}
+
+		for _, k := range keys {
+			if err := txn.Delete(k); err != nil {
+				return err
+			}
+		}
+		removed = len(keys)
+		if removed == 0 {
+			return nil
+		}
+		expiresAt, err := rowHeaderExpiry(txn, v.TableName(), owner, rowID, col)
+		if err != nil {
+			return err
+		}
+		if err := s.writeRevision(txn, v.TableName(), owner, rowID, expiresAt); err != nil {
+			return err
+		}
+		return s.writeChange(txn, v.TableName(), owner, rowID, Updated)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return removed, nil
+}
+
+// ScanElements walks the stored elements of T's expanded column for every row
+// of owner, in row order, calling fn with each element's row, key and value
+// until it returns false or an error. The key of a slice element is its
+// position, that of a map element is its map key.
+func ScanElements[T Value](s Store, owner kvs.UUID, column string, fn func(rowID uint32, key, value any) (bool, error)) error {
+	v := *new(T)
+	col, err := expandedColumn(v, column)
+	if err != nil {
+		return err
+	}
+
+	prefix := []byte(fmt.Sprintf("%s.%s.%s.", elementKeyPrefix, v.TableName(), ownerID(owner)))
+	return s.view(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+			row, rest, ok := strings.Cut(string(item.Key()[len(prefix):]), ".")
+			if !ok || !strings.HasPrefix(rest, col.Name+".") {
+				continue
+			}
+			rowID, err := strconv.ParseUint(row, 10, 32)
+			if err != nil {
+				return err
+			}
+			elemKey := []byte(rest[len(col.Name)+1:])
+
+			var key any
+			if col.Type.Kind() == reflect.Map {
+				if key, err = kvs.DecodeBytes(elemKey, kvs.OrderedEncoding, col.Type.Key()); err != nil {
+					return err
+				}
+			} else if len(elemKey) == 8 {
+				key = int(binary.BigEndian.Uint64(elemKey))
+			}
+
+			ent := kvs.Entry{}
+			if err := loadItemDataIntoEntry(&ent, item.Value); err != nil {
+				return err
+			}
+			value, err := kvs.DecodeBytes(ent.Data, kvs.Encoding(item.UserMeta()), col.Type.Elem())
+			if err != nil {
+				return err
+			}
+
+			more, err := fn(uint32(rowID), key, value)
+			if err != nil || !more {
+				return err
+			}
+		}
+		return nil
+	})
+}
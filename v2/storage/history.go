@@ -0,0 +1,368 @@
+// Copyright (c) 2023 Adam Prakash Stringer
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted (subject to the limitations in the disclaimer
+// below) provided that the following conditions are met:
+//
+//     * Redistributions of source code must retain the above copyright notice,
+//     this list of conditions and the following disclaimer.
+//
+//     * Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+//     * Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from this
+//     software without specific prior written permission.
+//
+// NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+// THIS LICENSE. THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR
+// BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER
+// IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/tauraamui/kvs/v2"
+)
+
+// Writes of a row through a store created WithRevisions also set its revision
+// key to the time they were made, as badger versions are commit timestamps
+// which don't tell the time. Older
+// versions of the key date older writes for as long as badger keeps them,
+// which is only more than the latest with Options.NumVersionsToKeep above 1.
+// Removing a row for good writes an already expired revision, so it is
+// hidden from everything but the row's history.
+//
+// _rev.TABLE_NAME.OWNERUUID.ROW_ID
+const revisionKeyPrefix = "_rev"
+
+func revisionKey(tableName string, owner kvs.UUID, rowID uint32) []byte {
+	return []byte(fmt.Sprintf("%s.%s.%s.%d", revisionKeyPrefix, tableName, ownerID(owner), rowID))
+}
+
+func revisionEntry(tableName string, owner kvs.UUID, rowID uint32, expiresAt uint64) *badger.Entry {
+	e := badger.NewEntry(revisionKey(tableName, owner, rowID), binary.BigEndian.AppendUint64(nil, uint64(time.Now().UnixNano())))
+	e.ExpiresAt = expiresAt
+	return e
+}
+
+// writeRevision dates the write unless the store doesn't record revisions.
+func (s Store) writeRevision(txn *badger.Txn, tableName string, owner kvs.UUID, rowID uint32, expiresAt uint64) error {
+	if !s.revisions {
+		return nil
+	}
+	return txn.SetEntry(revisionEntry(tableName, owner, rowID, expiresAt))
+}
+
+// removedExpiry is when the revision written by removing a row for good
+// expires, which tells it apart from the revisions of other writes.
+const removedExpiry = 1
+
+// removedRevision dates the write which removed a row for good.
+func removedRevision(tableName string, owner kvs.UUID, rowID uint32) *badger.Entry {
+	return revisionEntry(tableName, owner, rowID, removedExpiry)
+}
+
+// Revision is a row as it was left by one of its writes.
+type Revision[T Value] struct {
+	// Version is the commit timestamp of the write, LoadAt reads the row
+	// as it was at it.
+	Version uint64
+	// Time is when the write was made, it is zero for writes made through a
+	// store without WithRevisions.
+	Time time.Time
+	// Deleted is set when the write deleted the row, Row then holds what
+	// the row held if it was only soft deleted.
+	Deleted bool
+	Row     T
+}
+
+// keyVersion is one version of a key, removed if it was deleted by it.
+type keyVersion struct {
+	version   uint64
+	data      []byte
+	meta      byte
+	expiresAt uint64
+	removed   bool
+}
+
+// at returns the version of the key a read at version v sees, if any.
+func at(versions []keyVersion, v uint64) (keyVersion, bool) {
+	// versions are newest first
+	for _, kv := range versions {
+		if kv.version <= v {
+			return kv, !kv.removed
+		}
+	}
+	return keyVersion{}, false
+}
+
+// rowVersions is every version badger still keeps of each key of a row.
+type rowVersions struct {
+	columns   map[string][]keyVersion
+	elements  map[string][][]keyVersion
+	elemKeys  map[string][][]byte
+	tombstone []keyVersion
+	revision  []keyVersion
+}
+
+func readVersions(txn *badger.Txn, prefix []byte, exact bool, fn func(key []byte, versions []keyVersion)) error {
+	opts := badger.DefaultIteratorOptions
+	opts.AllVersions = true
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	now := uint64(time.Now().Unix())
+	var key []byte
+	var versions []keyVersion
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		item := it.Item()
+		if exact && !bytes.Equal(item.Key(), prefix) {
+			break
+		}
+		if key != nil && !bytes.Equal(item.Key(), key) {
+			fn(key, versions)
+			versions = nil
+		}
+		key = item.KeyCopy(nil)
+
+		// expired versions were still there when they were written over, only
+		// the newest version, which nothing has written over, is removed by
+		// its expiry. Expired versions keep their value, which dates the
+		// write for an expired revision.
+		kv := keyVersion{version: item.Version(), meta: item.UserMeta(), expiresAt: item.ExpiresAt()}
+		expired := item.ExpiresAt() != 0 && item.ExpiresAt() <= now
+		kv.removed = item.IsDeletedOrExpired() && (!expired || len(versions) == 0)
+		if !item.IsDeletedOrExpired() || expired {
+			data, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			kv.data = data
+		}
+		versions = append(versions, kv)
+	}
+	if key != nil {
+		fn(key, versions)
+	}
+	return nil
+}
+
+func readRowVersions(txn *badger.Txn, v Value, owner kvs.UUID, rowID uint32) (*rowVersions, error) {
+	rv := &rowVersions{columns: map[string][]keyVersion{}, elements: map[string][][]keyVersion{}, elemKeys: map[string][][]byte{}}
+	for _, ent := range kvs.ConvertToBlankEntries(v.TableName(), owner, rowID, v) {
+		if err := readVersions(txn, ent.Key(), true, func(_ []byte, versions []keyVersion) {
+			rv.columns[ent.ColumnName] = versions
+		}); err != nil {
+			return nil, err
+		}
+	}
+	for _, column := range expandedColumns(v) {
+		prefix := elementPrefix(v.TableName(), owner, rowID, column.Name)
+		if err := readVersions(txn, prefix, false, func(key []byte, versions []keyVersion) {
+			rv.elemKeys[column.Name] = append(rv.elemKeys[column.Name], key[len(prefix):])
+			rv.elements[column.Name] = append(rv.elements[column.Name], versions)
+		}); err != nil {
+			return nil, err
+		}
+	}
+	if err := readVersions(txn, tombstoneKey(v.TableName(), owner, rowID), true, func(_ []byte, versions []keyVersion) {
+		rv.tombstone = versions
+	}); err != nil {
+		return nil, err
+	}
+	err := readVersions(txn, revisionKey(v.TableName(), owner, rowID), true, func(_ []byte, versions []keyVersion) {
+		rv.revision = versions
+	})
+	return rv, err
+}
+
+// commits lists the version of every write to the row, oldest first.
+func (rv *rowVersions) commits() []uint64 {
+	seen := map[uint64]bool{}
+	add := func(versions []keyVersion) {
+		for _, kv := range versions {
+			seen[kv.version] = true
+		}
+	}
+	for _, versions := range rv.columns {
+		add(versions)
+	}
+	for _, elems := range rv.elements {
+		for _, versions := range elems {
+			add(versions)
+		}
+	}
+	add(rv.tombstone)
+	add(rv.revision)
+
+	commits := make([]uint64, 0, len(seen))
+	for v := range seen {
+		commits = append(commits, v)
+	}
+	sort.Slice(commits, func(i, j int) bool { return commits[i] < commits[j] })
+	return commits
+}
+
+// lifetime drops the commits made before the row was last removed for good,
+// unless that is its latest commit. A row written under the same ID again
+// afterwards shares none of its history with the one removed.
+func (rv *rowVersions) lifetime(commits []uint64) []uint64 {
+	for i := len(commits) - 2; i >= 0; i-- {
+		if rv.removedBy(commits[i]) {
+			return commits[i+1:]
+		}
+	}
+	return commits
+}
+
+// removedBy reports whether the write committed at version removed the row
+// for good.
+func (rv *rowVersions) removedBy(version uint64) bool {
+	for _, kv := range rv.revision {
+		if kv.version == version {
+			return kv.expiresAt == removedExpiry
+		}
+	}
+	return false
+}
+
+// timeOf returns when the write committed at version was made, if its
+// revision is known.
+func (rv *rowVersions) timeOf(version uint64) time.Time {
+	for _, kv := range rv.revision {
+		if kv.version == version && len(kv.data) == 8 {
+			return time.Unix(0, int64(binary.BigEndian.Uint64(kv.data))).UTC()
+		}
+	}
+	return time.Time{}
+}
+
+// loadAt reads the row into dest as a read at version would have seen it,
+// reporting whether it was deleted by then.
+func (rv *rowVersions) loadAt(dest any, owner kvs.UUID, rowID uint32, version uint64) (bool, error) {
+	present := 0
+	for _, c := range kvs.Columns(dest) {
+		kv, ok := at(rv.columns[c.Name], version)
+		if !ok {
+			if err := kvs.SetColumnValue(dest, c.Name, nil); err != nil {
+				return false, err
+			}
+			continue
+		}
+		present++
+		ent := kvs.Entry{ColumnName: c.Name, Data: kv.data, Meta: kv.meta}
+		if err := kvs.LoadEntry(dest, ent); err != nil {
+			return false, err
+		}
+	}
+
+	for _, column := range expandedColumns(dest) {
+		elems := []storedElement{}
+		for i, versions := range rv.elements[column.Name] {
+			if kv, ok := at(versions, version); ok {
+				elems = append(elems, storedElement{key: rv.elemKeys[column.Name][i], data: kv.data, meta: kv.meta})
+			}
+		}
+		if err := setElements(dest, column, elems); err != nil {
+			return false, err
+		}
+	}
+
+	if err := kvs.LoadID(dest, rowID); err != nil {
+		return false, err
+	}
+	_, softDeleted := at(rv.tombstone, version)
+	return present == 0 || softDeleted, nil
+}
+
+// History reassembles every past version of the given row badger still
+// keeps, oldest first. How far back it goes depends on the database's
+// Options.NumVersionsToKeep, and with WithRevisions it never goes back past
+// the last time the row was removed for good before being written again.
+func History[T Value](s Store, owner kvs.UUID, rowID uint32) ([]Revision[T], error) {
+	history := []Revision[T]{}
+	err := s.view(func(txn *badger.Txn) error {
+		rv, err := readRowVersions(txn, *new(T), owner, rowID)
+		if err != nil {
+			return err
+		}
+
+		for _, version := range rv.lifetime(rv.commits()) {
+			revision := Revision[T]{Version: version, Time: rv.timeOf(version)}
+			if revision.Deleted, err = rv.loadAt(&revision.Row, owner, rowID, version); err != nil {
+				return err
+			}
+			history = append(history, revision)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return history, nil
+}
+
+// LoadAt reads the given row into dest as it was at the read timestamp ts,
+// such as the Version of one of its revisions. ErrRowNotFound is returned if
+// the row didn't exist or was deleted at that point.
+func LoadAt[T Value](s Store, dest T, owner kvs.UUID, rowID uint32, ts uint64) error {
+	return s.view(func(txn *badger.Txn) error {
+		rv, err := readRowVersions(txn, dest, owner, rowID)
+		if err != nil {
+			return err
+		}
+		return loadRowAt(rv, dest, owner, rowID, ts)
+	})
+}
+
+// LoadAsOf reads the given row into dest as it was at t, going by the times
+// its writes were made at, so only writes made through stores created
+// WithRevisions are seen.
+func LoadAsOf[T Value](s Store, dest T, owner kvs.UUID, rowID uint32, t time.Time) error {
+	return s.view(func(txn *badger.Txn) error {
+		rv, err := readRowVersions(txn, dest, owner, rowID)
+		if err != nil {
+			return err
+		}
+
+		var ts uint64
+		for _, version := range rv.commits() {
+			if made := rv.timeOf(version); !made.IsZero() && !made.After(t) {
+				ts = version
+			}
+		}
+		if ts == 0 {
+			return fmt.Errorf("%w: row %d of %s as of %s", ErrRowNotFound, rowID, dest.TableName(), t)
+		}
+		return loadRowAt(rv, dest, owner, rowID, ts)
+	})
+}
+
+func loadRowAt(rv *rowVersions, dest Value, owner kvs.UUID, rowID uint32, ts uint64) error {
+	deleted, err := rv.loadAt(dest, owner, rowID, ts)
+	if err != nil {
+		return err
+	}
+	if deleted {
+		return fmt.Errorf("%w: row %d of %s at version %d", ErrRowNotFound, rowID, dest.TableName(), ts)
+	}
+	return nil
+}
@@ -0,0 +1,309 @@
+// Copyright (c) 2023 Adam Prakash Stringer
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted (subject to the limitations in the disclaimer
+// below) provided that the following conditions are met:
+//
+//     * Redistributions of source code must retain the above copyright notice,
+//     this list of conditions and the following disclaimer.
+//
+//     * Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+//     * Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from this
+//     software without specific prior written permission.
+//
+// NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+// THIS LICENSE. THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR
+// BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER
+// IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/tauraamui/kvs/v2"
+)
+
+// Index entries live under their own prefix, one key per row, made up of the
+// column's value in kvs.OrderedEncoding followed by the row's ID. Keys are
+// written in the same transaction as the row's columns so they can't drift,
+// as long as every write goes through a type which tags the column, see
+// Reindex for when it doesn't.
+//
+// _idx.TABLE_NAME.OWNERUUID.COLUMN_NAME.<escaped value><terminator><big endian row id>
+//
+// The value is escaped and terminated so that keys sort by value first, even
+// when one value is a prefix of another.
+const indexKeyPrefix = "_idx"
+
+var indexValueTerminator = []byte{0x00, 0x01}
+
+func indexPrefix(tableName string, owner kvs.UUID, column string) []byte {
+	return []byte(fmt.Sprintf("%s.%s.%s.%s.", indexKeyPrefix, tableName, ownerID(owner), column))
+}
+
+func indexKey(prefix, value []byte, rowID uint32) []byte {
+	key := append(append([]byte{}, prefix...), escapeIndexValue(value)...)
+	key = append(key, indexValueTerminator...)
+	return binary.BigEndian.AppendUint32(key, rowID)
+}
+
+func parseIndexKey(prefix, key []byte) ([]byte, uint32, error) {
+	rest := key[len(prefix):]
+	if len(rest) < len(indexValueTerminator)+4 {
+		return nil, 0, fmt.Errorf("malformed index key: %q", key)
+	}
+	rowID := binary.BigEndian.Uint32(rest[len(rest)-4:])
+	return unescapeIndexValue(rest[:len(rest)-4-len(indexValueTerminator)]), rowID, nil
+}
+
+func escapeIndexValue(value []byte) []byte {
+	return bytes.ReplaceAll(value, []byte{0x00}, []byte{0x00, 0xFF})
+}
+
+func unescapeIndexValue(value []byte) []byte {
+	return bytes.ReplaceAll(value, []byte{0x00, 0xFF}, []byte{0x00})
+}
+
+func ownerID(owner kvs.UUID) string {
+	if owner == nil {
+		owner = kvs.RootOwner{}
+	}
+	return owner.String()
+}
+
+func indexedColumns(v any) []kvs.Column {
+	indexed := []kvs.Column{}
+	for _, c := range kvs.Columns(v) {
+		if c.Index {
+			indexed = append(indexed, c)
+		}
+	}
+	return indexed
+}
+
+// storedOrderedValue resolves the ordered encoding of the row's column as it
+// is currently stored, before the transaction writes over it.
+func storedOrderedValue(txn *badger.Txn, tableName string, owner kvs.UUID, rowID uint32, column kvs.Column) ([]byte, bool, error) {
+	ent := kvs.Entry{TableName: tableName, ColumnName: column.Name, OwnerUUID: owner, RowID: rowID}
+	item, err := txn.Get(ent.Key())
+	if err != nil {
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+
+	if err := loadItemDataIntoEntry(&ent, item.Value); err != nil {
+		return nil, false, err
+	}
+	ent.Meta = item.UserMeta()
+
+	stored, err := kvs.DecodeBytes(ent.Data, kvs.Encoding(ent.Meta), column.Type)
+	if err != nil {
+		return nil, false, err
+	}
+	encoded, err := kvs.EncodeOrdered(stored)
+	return encoded, true, err
+}
+
+func writeIndexes(txn *badger.Txn, owner kvs.UUID, rowID uint32, v Value, expiresAt uint64) error {
+	for _, column := range indexedColumns(v) {
+		prefix := indexPrefix(v.TableName(), owner, column.Name)
+		old, found, err := storedOrderedValue(txn, v.TableName(), owner, rowID, column)
+		if err != nil {
+			return err
+		}
+
+		current, err := kvs.ColumnValue(v, column.Name)
+		if err != nil {
+			return err
+		}
+		value, err := kvs.EncodeOrdered(current)
+		if err != nil {
+			return err
+		}
+
+		if found && !bytes.Equal(old, value) {
+			if err := txn.Delete(indexKey(prefix, old, rowID)); err != nil {
+				return err
+			}
+		}
+		e := badger.NewEntry(indexKey(prefix, value, rowID), nil)
+		e.ExpiresAt = expiresAt
+		if err := txn.SetEntry(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func deleteIndexes(txn *badger.Txn, owner kvs.UUID, rowID uint32, v Value) error {
+	for _, column := range indexedColumns(v) {
+		old, found, err := storedOrderedValue(txn, v.TableName(), owner, rowID, column)
+		if err != nil {
+			return err
+		}
+		if !found {
+			continue
+		}
+		if err := txn.Delete(indexKey(indexPrefix(v.TableName(), owner, column.Name), old, rowID)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ScanIndex walks the index of T's column for owner in value order, starting
+// at the first value greater than or equal to from, which is encoded with
+// kvs.EncodeOrdered. A nil from starts at the lowest value. Iteration carries
+// on until fn returns false or an error.
+func ScanIndex[T Value](s Store, owner kvs.UUID, column string, from []byte, fn func(value []byte, rowID uint32) (bool, error)) error {
+	v := *new(T)
+	prefix := indexPrefix(v.TableName(), owner, column)
+
+	return s.view(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		seek := append(append([]byte{}, prefix...), escapeIndexValue(from)...)
+		for it.Seek(seek); it.ValidForPrefix(prefix); it.Next() {
+			value, rowID, err := parseIndexKey(prefix, it.Item().Key())
+			if err != nil {
+				return err
+			}
+			more, err := fn(value, rowID)
+			if err != nil {
+				return err
+			}
+			if !more {
+				return nil
+			}
+		}
+		return nil
+	})
+}
+
+// ScanIndexReverse walks the index like ScanIndex but from the highest value
+// down, starting at the last value less than or equal to from. A nil from
+// starts at the highest value.
+func ScanIndexReverse[T Value](s Store, owner kvs.UUID, column string, from []byte, fn func(value []byte, rowID uint32) (bool, error)) error {
+	v := *new(T)
+	prefix := indexPrefix(v.TableName(), owner, column)
+
+	return s.view(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Reverse = true
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		// sorts after every key holding from, but before those of any longer value
+		seek := append(append([]byte{}, prefix...), 0xFF)
+		if from != nil {
+			seek = append(append(append([]byte{}, prefix...), escapeIndexValue(from)...), 0x00, 0x02)
+		}
+		for it.Seek(seek); it.ValidForPrefix(prefix); it.Next() {
+			value, rowID, err := parseIndexKey(prefix, it.Item().Key())
+			if err != nil {
+				return err
+			}
+			more, err := fn(value, rowID)
+			if err != nil {
+				return err
+			}
+			if !more {
+				return nil
+			}
+		}
+		return nil
+	})
+}
+
+// Reindex rebuilds the indexes of T's tagged columns for every row of owner,
+// soft deleted ones included, clearing out whatever the indexes held before.
+// Indexes are only kept up to date by writes through a type which tags the
+// column, so Reindex has to be run after tagging a column of a table which
+// already has rows, or after writing rows through a type which doesn't tag
+// it. Until then index backed queries and orderings leave out the rows which
+// are missing from the index. The index is rewritten in batches of
+// transactions rather than one, so that tables of any size can be reindexed,
+// and queries made while it runs can miss rows.
+func Reindex[T Value](s Store, owner kvs.UUID) error {
+	v := *new(T)
+	indexed := indexedColumns(v)
+	if len(indexed) == 0 {
+		return nil
+	}
+	data := map[string]bool{}
+	for _, column := range indexed {
+		data[column.Name] = true
+	}
+
+	wb := s.newDeleter()
+	defer wb.Cancel()
+
+	if err := s.view(func(txn *badger.Txn) error {
+		for _, column := range indexed {
+			if err := eachKey(txn, indexPrefix(v.TableName(), owner, column.Name), wb.Delete); err != nil {
+				return err
+			}
+		}
+
+		src := newMergedRows(txn, kvs.ConvertToBlankEntries(v.TableName(), owner, 0, v), nil, data, allRows)
+		defer src.close()
+		for {
+			rowID, entries, ok, err := src.next()
+			if err != nil || !ok {
+				return err
+			}
+
+			stored := map[string]kvs.Entry{}
+			for _, ent := range entries {
+				stored[ent.ColumnName] = ent
+			}
+			for _, column := range indexed {
+				// rows saved before the column existed index its zero value,
+				// which is what they load with
+				var current any = reflect.Zero(column.Type).Interface()
+				if ent, ok := stored[column.Name]; ok {
+					if current, err = kvs.DecodeBytes(ent.Data, kvs.Encoding(ent.Meta), column.Type); err != nil {
+						return err
+					}
+				}
+				value, err := kvs.EncodeOrdered(current)
+				if err != nil {
+					return err
+				}
+				e := badger.NewEntry(indexKey(indexPrefix(v.TableName(), owner, column.Name), value, rowID), nil)
+				e.ExpiresAt = entries[0].ExpiresAt
+				if err := wb.SetEntry(e); err != nil {
+					return err
+				}
+			}
+		}
+	}); err != nil {
+		return err
+	}
+	return wb.Flush()
+}
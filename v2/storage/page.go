@@ -0,0 +1,608 @@
+// Copyright (c) 2023 Adam Prakash Stringer
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted (subject to the limitations in the disclaimer
+// below) provided that the following conditions are met:
+//
+//     * Redistributions of source code must retain the above copyright notice,
+//     this list of conditions and the following disclaimer.
+//
+//     * Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+//     * Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from this
+//     software without specific prior written permission.
+//
+// NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+// THIS LICENSE. THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR
+// BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER
+// IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package storage
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/tauraamui/kvs/v2"
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Cursor is an opaque position in an owner's rows, resuming from it carries
+// on with the row after the one it was taken at. Rows are walked in the order
+// of their keys, so a cursor stays valid when rows are inserted or deleted.
+type Cursor string
+
+func cursorFor(rowID uint32) Cursor {
+	return Cursor(base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatUint(uint64(rowID), 10))))
+}
+
+// rowKey decodes the cursor into the row ID suffix of the keys it points at.
+func (c Cursor) rowKey() ([]byte, error) {
+	if c == "" {
+		return nil, nil
+	}
+	key, err := base64.RawURLEncoding.DecodeString(string(c))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidCursor, err)
+	}
+	if _, err := strconv.ParseUint(string(key), 10, 32); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidCursor, err)
+	}
+	return key, nil
+}
+
+// Page selects a window of rows. Offset rows are skipped after the cursor, and
+// at most Limit rows are returned, where a Limit of zero means no limit.
+type Page struct {
+	Limit  int
+	Offset int
+	After  Cursor
+}
+
+// Projection limits loading to some of a table's columns, the fields of the
+// others are left at their zero value. Naming a flattened struct field selects
+// every column flattened from it. Columns only listed in Read are read for the
+// evaluator to see, but not loaded. A projection without Columns loads every
+// column.
+type Projection struct {
+	Columns []string
+	Read    []string
+}
+
+func resolveColumnNames(v any, names []string) (map[string]bool, error) {
+	resolved := map[string]bool{}
+	for _, name := range names {
+		name = strings.ToLower(name)
+		found := false
+		for _, c := range kvs.Columns(v) {
+			if c.Name == name || strings.HasPrefix(c.Name, name+".") {
+				resolved[c.Name] = true
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("column %s not found", name)
+		}
+	}
+	return resolved, nil
+}
+
+// resolve returns the blank entries of the columns to scan, along with the
+// set of columns whose data has to be read and the set of columns to load.
+// Both sets are nil when every column is read and loaded. Every column is
+// scanned, those which aren't read only for their keys, so rows are found
+// through whichever of their columns they have stored.
+func (p Projection) resolve(v Value, owner kvs.UUID) ([]kvs.Entry, map[string]bool, map[string]bool, error) {
+	blankEntries := kvs.ConvertToBlankEntries(v.TableName(), owner, 0, v)
+	if len(p.Columns) == 0 {
+		return blankEntries, nil, nil, nil
+	}
+
+	load, err := resolveColumnNames(v, p.Columns)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	read, err := resolveColumnNames(v, p.Read)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	for column := range load {
+		read[column] = true
+	}
+	return blankEntries, read, load, nil
+}
+
+// RowEvaluator decides whether a row is loaded from all of its stored entries,
+// keyed by column name. Columns the row has no entry for are absent.
+type RowEvaluator func(row map[string]kvs.Entry) (bool, error)
+
+// entryEvaluator adapts an evaluator of single entries, which a row has to
+// satisfy with every entry.
+func entryEvaluator(pred func(e kvs.Entry) (bool, error)) RowEvaluator {
+	if pred == nil {
+		return nil
+	}
+	return func(row map[string]kvs.Entry) (bool, error) {
+		for _, e := range row {
+			if ok, err := pred(e); err != nil || !ok {
+				return false, err
+			}
+		}
+		return true, nil
+	}
+}
+
+// rowSource yields the stored entries of one row at a time, in the order the
+// rows are laid out in the keyspace.
+type rowSource interface {
+	next() (rowID uint32, entries []kvs.Entry, ok bool, err error)
+	close()
+}
+
+// shownRows hands out only the entries of the given columns, the entries of
+// the others only tell that the row is there.
+type shownRows struct {
+	rowSource
+	columns map[string]bool
+}
+
+// showColumns has src hand out only the entries of columns, unless it is nil.
+func showColumns(src rowSource, columns map[string]bool) rowSource {
+	if columns == nil {
+		return src
+	}
+	return shownRows{rowSource: src, columns: columns}
+}
+
+func (r shownRows) next() (uint32, []kvs.Entry, bool, error) {
+	rowID, entries, ok, err := r.rowSource.next()
+	shown := make([]kvs.Entry, 0, len(entries))
+	for _, ent := range entries {
+		if r.columns[ent.ColumnName] {
+			shown = append(shown, ent)
+		}
+	}
+	return rowID, shown, ok, err
+}
+
+type columnScan struct {
+	it       *badger.Iterator
+	prefix   []byte
+	ent      kvs.Entry
+	keysOnly bool
+}
+
+func (c *columnScan) rowKey() []byte {
+	if !c.it.ValidForPrefix(c.prefix) {
+		return nil
+	}
+	return c.it.Item().Key()[len(c.prefix):]
+}
+
+// mergedRows walks every column of a table at once, with one iterator per
+// column. Each step takes the lowest row key any column is on, so a row
+// missing some of its columns doesn't throw the others out of step. Only the
+// data of the columns in data is read, unless it is nil, the entries of the
+// others only mark the column as present. Which rows are yielded depends on
+// whether they were soft deleted, as selected by deleted.
+type mergedRows struct {
+	txn     *badger.Txn
+	scans   []*columnScan
+	deleted deletedRows
+}
+
+func newMergedRows(txn *badger.Txn, blankEntries []kvs.Entry, after []byte, data map[string]bool, deleted deletedRows) *mergedRows {
+	rows := &mergedRows{txn: txn, deleted: deleted}
+	for _, ent := range blankEntries {
+		keysOnly := data != nil && !data[ent.ColumnName]
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = !keysOnly
+		scan := &columnScan{
+			it:       txn.NewIterator(opts),
+			prefix:   append(ent.PrefixKey(), '.'),
+			ent:      ent,
+			keysOnly: keysOnly,
+		}
+
+		seek := scan.prefix
+		if after != nil {
+			// the smallest key after the cursor's own row
+			seek = append(append(append([]byte{}, scan.prefix...), after...), 0x00)
+		}
+		scan.it.Seek(seek)
+		rows.scans = append(rows.scans, scan)
+	}
+	return rows
+}
+
+func (r *mergedRows) next() (uint32, []kvs.Entry, bool, error) {
+	for {
+		var lowest []byte
+		for _, scan := range r.scans {
+			if key := scan.rowKey(); key != nil && (lowest == nil || bytes.Compare(key, lowest) < 0) {
+				lowest = key
+			}
+		}
+		if lowest == nil {
+			return 0, nil, false, nil
+		}
+
+		rowID, err := strconv.ParseUint(string(lowest), 10, 32)
+		if err != nil {
+			return 0, nil, false, err
+		}
+		lowest = append([]byte{}, lowest...)
+
+		entries := []kvs.Entry{}
+		for _, scan := range r.scans {
+			if !bytes.Equal(scan.rowKey(), lowest) {
+				continue
+			}
+			ent := scan.ent
+			ent.RowID = uint32(rowID)
+			item := scan.it.Item()
+			if !scan.keysOnly {
+				if err := loadItemDataIntoEntry(&ent, item.Value); err != nil {
+					return 0, nil, false, err
+				}
+			}
+			ent.Meta = item.UserMeta()
+			ent.ExpiresAt = item.ExpiresAt()
+			entries = append(entries, ent)
+			scan.it.Next()
+		}
+		if rowExpired(entries) {
+			continue
+		}
+		keep, err := r.deleted.keep(r.txn, entries)
+		if err != nil {
+			return 0, nil, false, err
+		}
+		if keep {
+			return uint32(rowID), entries, true, nil
+		}
+	}
+}
+
+func (r *mergedRows) close() {
+	for _, scan := range r.scans {
+		scan.it.Close()
+	}
+}
+
+// listedRows looks up the given rows one by one, skipping those which have no
+// stored columns. As with mergedRows only the data of the columns in data is
+// read, unless it is nil.
+type listedRows struct {
+	txn          *badger.Txn
+	ids          []uint32
+	blankEntries []kvs.Entry
+	data         map[string]bool
+	deleted      deletedRows
+}
+
+func newListedRows(txn *badger.Txn, rowIDs []uint32, blankEntries []kvs.Entry, after []byte, data map[string]bool, deleted deletedRows) *listedRows {
+	ids := make([]uint32, 0, len(rowIDs))
+	for _, rowID := range rowIDs {
+		if after == nil || strconv.FormatUint(uint64(rowID), 10) > string(after) {
+			ids = append(ids, rowID)
+		}
+	}
+	sortRowIDs(ids)
+	return &listedRows{txn: txn, ids: ids, blankEntries: blankEntries, data: data, deleted: deleted}
+}
+
+func (r *listedRows) next() (uint32, []kvs.Entry, bool, error) {
+	for len(r.ids) > 0 {
+		rowID := r.ids[0]
+		r.ids = r.ids[1:]
+
+		entries := []kvs.Entry{}
+		for _, ent := range r.blankEntries {
+			ent.RowID = rowID
+			item, err := r.txn.Get(ent.Key())
+			if err != nil {
+				if errors.Is(err, badger.ErrKeyNotFound) {
+					continue
+				}
+				return 0, nil, false, err
+			}
+			if r.data == nil || r.data[ent.ColumnName] {
+				if err := loadItemDataIntoEntry(&ent, item.Value); err != nil {
+					return 0, nil, false, err
+				}
+			}
+			ent.Meta = item.UserMeta()
+			ent.ExpiresAt = item.ExpiresAt()
+			entries = append(entries, ent)
+		}
+		if len(entries) == 0 || rowExpired(entries) {
+			continue
+		}
+		keep, err := r.deleted.keep(r.txn, entries)
+		if err != nil {
+			return 0, nil, false, err
+		}
+		if keep {
+			return rowID, entries, true, nil
+		}
+	}
+	return 0, nil, false, nil
+}
+
+func (r *listedRows) close() {}
+
+// eachRow builds the rows of src which pred accepts and hands them to fn one
+// at a time, applying the page as it goes. It stops early when fn returns
+// false. The returned cursor is empty unless the page's limit was reached with
+// more matching rows left after the last one handed over.
+func eachRow[T Value](txn *badger.Txn, owner kvs.UUID, src rowSource, pred RowEvaluator, page Page, load map[string]bool, fn func(row T) (bool, error)) (Cursor, error) {
+	defer src.close()
+
+	tableName := (*new(T)).TableName()
+	legacy := kvs.ConvertToLegacyEntries(tableName, owner, 0, *new(T))
+	count, skipped := 0, 0
+	var last uint32
+	for {
+		rowID, entries, ok, err := src.next()
+		if err != nil {
+			return "", err
+		}
+		if !ok {
+			return "", nil
+		}
+
+		if pred != nil {
+			row := make(map[string]kvs.Entry, len(entries))
+			for _, ent := range entries {
+				row[ent.ColumnName] = ent
+			}
+			included, err := pred(row)
+			if err != nil {
+				return "", err
+			}
+			if !included {
+				continue
+			}
+		}
+
+		if page.Limit > 0 && count == page.Limit {
+			// there is at least one more matching row, so hand out a cursor
+			return cursorFor(last), nil
+		}
+		if skipped < page.Offset {
+			skipped++
+			continue
+		}
+
+		row := *new(T)
+		present := make(map[string]bool, len(entries))
+		for _, ent := range entries {
+			present[ent.ColumnName] = true
+			if load != nil && !load[ent.ColumnName] {
+				continue
+			}
+			if err := kvs.LoadEntry(&row, ent); err != nil {
+				return "", err
+			}
+		}
+		if err := loadLegacyStructs(txn, legacy, rowID, &row, present, load); err != nil {
+			return "", err
+		}
+		if err := loadElements(txn, tableName, owner, rowID, &row, load); err != nil {
+			return "", err
+		}
+		if rowExpired(entries) {
+			// it expired while its elements were read, some may be missing
+			continue
+		}
+		if err := kvs.LoadID(&row, rowID); err != nil {
+			return "", err
+		}
+
+		count++
+		last = rowID
+		more, err := fn(row)
+		if err != nil || !more {
+			return "", err
+		}
+	}
+}
+
+// ErrStop can be returned from a ForEach callback to stop iterating early,
+// ForEach then returns nil rather than the error.
+var ErrStop = errors.New("stop iteration")
+
+// ForEach hands every row of owner to fn one at a time, in the order LoadAll
+// returns them, without holding on to rows fn has been handed.
+func ForEach[T Value](s Store, owner kvs.UUID, fn func(row T) error) error {
+	_, err := ForEachProjected[T](s, owner, nil, Projection{}, nil, Page{}, fn)
+	return err
+}
+
+// ForEachProjected hands the rows LoadProjectedPage would return to fn one
+// at a time, limited to rowIDs unless it is nil. It returns the cursor of the
+// next page, which is empty when fn stopped early or there are no more rows.
+func ForEachProjected[T Value](s Store, owner kvs.UUID, rowIDs []uint32, proj Projection, pred RowEvaluator, page Page, fn func(row T) error) (Cursor, error) {
+	after, err := page.After.rowKey()
+	if err != nil {
+		return "", err
+	}
+
+	blankEntries, data, load, err := proj.resolve(*new(T), owner)
+	if err != nil {
+		return "", err
+	}
+
+	var cursor Cursor
+	err = s.view(func(txn *badger.Txn) error {
+		var src rowSource
+		if rowIDs != nil {
+			src = newListedRows(txn, rowIDs, blankEntries, after, data, liveRowsOf(*new(T)))
+		} else {
+			src = newMergedRows(txn, blankEntries, after, data, liveRowsOf(*new(T)))
+		}
+		cursor, err = eachRow(txn, owner, showColumns(src, data), pred, page, load, func(row T) (bool, error) {
+			if err := fn(row); err != nil {
+				if errors.Is(err, ErrStop) {
+					return false, nil
+				}
+				return false, err
+			}
+			return true, nil
+		})
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return cursor, nil
+}
+
+func collectRows[T Value](s Store, owner kvs.UUID, rowIDs []uint32, proj Projection, pred RowEvaluator, page Page) ([]T, Cursor, error) {
+	dest := []T{}
+	cursor, err := ForEachProjected(s, owner, rowIDs, proj, pred, page, func(row T) error {
+		dest = append(dest, row)
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return dest, cursor, nil
+}
+
+// LoadPage loads a page of owner's rows, along with the cursor to pass as
+// the After of the next page.
+func LoadPage[T Value](s Store, owner kvs.UUID, page Page) ([]T, Cursor, error) {
+	return LoadPageWithEvaluator[T](s, owner, nil, page)
+}
+
+// LoadPageWithEvaluator loads a page of owner's rows which the evaluator
+// accepts every entry of, rows it rejects don't count towards the page.
+func LoadPageWithEvaluator[T Value](s Store, owner kvs.UUID, pred func(e kvs.Entry) (bool, error), page Page) ([]T, Cursor, error) {
+	return LoadPageWithRowEvaluator[T](s, owner, entryEvaluator(pred), page)
+}
+
+// LoadPageWithRowEvaluator loads a page of owner's rows which the evaluator
+// accepts, rows it rejects don't count towards the page.
+func LoadPageWithRowEvaluator[T Value](s Store, owner kvs.UUID, pred RowEvaluator, page Page) ([]T, Cursor, error) {
+	return LoadProjectedPage[T](s, owner, Projection{}, pred, page)
+}
+
+// LoadAllColumns loads every row of owner like LoadAll, but only reads the
+// given columns, leaving the other fields at their zero value.
+func LoadAllColumns[T Value](s Store, owner kvs.UUID, columns ...string) ([]T, error) {
+	dest, _, err := LoadProjectedPage[T](s, owner, Projection{Columns: columns}, nil, Page{})
+	return dest, err
+}
+
+// LoadProjectedPage loads a page of owner's rows which the evaluator accepts,
+// reading only the projection's columns. The evaluator only sees entries for
+// the columns the projection reads, rows are found through any of their
+// columns though, so rows with none of those stored are still handed to it.
+func LoadProjectedPage[T Value](s Store, owner kvs.UUID, proj Projection, pred RowEvaluator, page Page) ([]T, Cursor, error) {
+	return collectRows[T](s, owner, nil, proj, pred, page)
+}
+
+// LoadRowsPageWithEvaluator is LoadPageWithEvaluator limited to the given rows.
+func LoadRowsPageWithEvaluator[T Value](s Store, owner kvs.UUID, rowIDs []uint32, pred func(e kvs.Entry) (bool, error), page Page) ([]T, Cursor, error) {
+	return LoadRowsPageWithRowEvaluator[T](s, owner, rowIDs, entryEvaluator(pred), page)
+}
+
+// LoadRowsPageWithRowEvaluator is LoadPageWithRowEvaluator limited to the
+// given rows.
+func LoadRowsPageWithRowEvaluator[T Value](s Store, owner kvs.UUID, rowIDs []uint32, pred RowEvaluator, page Page) ([]T, Cursor, error) {
+	return LoadRowsProjectedPage[T](s, owner, rowIDs, Projection{}, pred, page)
+}
+
+// LoadRowsProjectedPage is LoadProjectedPage limited to the given rows.
+func LoadRowsProjectedPage[T Value](s Store, owner kvs.UUID, rowIDs []uint32, proj Projection, pred RowEvaluator, page Page) ([]T, Cursor, error) {
+	if rowIDs == nil {
+		rowIDs = []uint32{}
+	}
+	return collectRows[T](s, owner, rowIDs, proj, pred, page)
+}
+
+// RowScan describes a walk over an owner's rows which hands over their stored
+// entries rather than loading them into values.
+type RowScan struct {
+	// Columns are the columns whose data is read, every column's is when it
+	// is empty. Rows only have entries for these columns, but are walked as
+	// long as they have any column stored.
+	Columns []string
+	// Rows limits the walk to the given rows, unless it is nil.
+	Rows []uint32
+	// KeysOnly skips reading the entries' data, so it can't be combined with
+	// an evaluator which looks at it.
+	KeysOnly bool
+	Eval     RowEvaluator
+}
+
+// ScanRows walks owner's rows which scan's evaluator accepts, in the order
+// LoadAll returns them, calling fn with each row's entries until it returns
+// false or an error. Rows without any stored columns are skipped.
+func ScanRows[T Value](s Store, owner kvs.UUID, scan RowScan, fn func(rowID uint32, row map[string]kvs.Entry) (bool, error)) error {
+	blankEntries, shown, _, err := Projection{Columns: scan.Columns}.resolve(*new(T), owner)
+	if err != nil {
+		return err
+	}
+	data := shown
+	if scan.KeysOnly {
+		data = map[string]bool{}
+	}
+
+	return s.view(func(txn *badger.Txn) error {
+		var src rowSource
+		if scan.Rows != nil {
+			src = newListedRows(txn, scan.Rows, blankEntries, nil, data, liveRowsOf(*new(T)))
+		} else {
+			src = newMergedRows(txn, blankEntries, nil, data, liveRowsOf(*new(T)))
+		}
+		src = showColumns(src, shown)
+		defer src.close()
+
+		for {
+			rowID, entries, ok, err := src.next()
+			if err != nil || !ok {
+				return err
+			}
+
+			row := make(map[string]kvs.Entry, len(entries))
+			for _, ent := range entries {
+				row[ent.ColumnName] = ent
+			}
+			if scan.Eval != nil {
+				included, err := scan.Eval(row)
+				if err != nil {
+					return err
+				}
+				if !included {
+					continue
+				}
+			}
+
+			more, err := fn(rowID, row)
+			if err != nil || !more {
+				return err
+			}
+		}
+	})
+}
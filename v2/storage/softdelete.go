@@ -0,0 +1,208 @@
+// Copyright (c) 2023 Adam Prakash Stringer
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted (subject to the limitations in the disclaimer
+// below) provided that the following conditions are met:
+//
+//     * Redistributions of source code must retain the above copyright notice,
+//     this list of conditions and the following disclaimer.
+//
+//     * Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+//     * Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from this
+//     software without specific prior written permission.
+//
+// NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+// THIS LICENSE. THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR
+// BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER
+// IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/tauraamui/kvs/v2"
+)
+
+// Soft deleted rows keep every key they had, plus a tombstone holding the
+// time they were deleted at as big endian unix nanoseconds. Rows with a
+// tombstone are skipped by every read unless deleted rows are asked for.
+//
+// _del.TABLE_NAME.OWNERUUID.ROW_ID
+//
+// Unique claims stay with a soft deleted row, so it can always be restored.
+const tombstoneKeyPrefix = "_del"
+
+// SoftDeleteValue can be implemented by a value to have Delete only mark rows
+// of its table as deleted while SoftDelete returns true.
+type SoftDeleteValue interface {
+	Value
+	SoftDelete() bool
+}
+
+// DeletedRow is a soft deleted row along with when it was deleted.
+type DeletedRow[T Value] struct {
+	Row       T
+	DeletedAt time.Time
+}
+
+func softDeletes(v Value) bool {
+	sv, ok := v.(SoftDeleteValue)
+	return ok && sv.SoftDelete()
+}
+
+func tombstoneKey(tableName string, owner kvs.UUID, rowID uint32) []byte {
+	return []byte(fmt.Sprintf("%s.%s.%s.%d", tombstoneKeyPrefix, tableName, ownerID(owner), rowID))
+}
+
+// deletedAt returns when the row was soft deleted, the zero time if it wasn't.
+func deletedAt(txn *badger.Txn, tableName string, owner kvs.UUID, rowID uint32) (time.Time, error) {
+	item, err := txn.Get(tombstoneKey(tableName, owner, rowID))
+	if err != nil {
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return time.Time{}, nil
+		}
+		return time.Time{}, err
+	}
+	var at time.Time
+	err = item.Value(func(val []byte) error {
+		if len(val) != 8 {
+			return fmt.Errorf("tombstone must be 8 bytes, got %d", len(val))
+		}
+		at = time.Unix(0, int64(binary.BigEndian.Uint64(val))).UTC()
+		return nil
+	})
+	return at, err
+}
+
+// deletedRows selects which rows a row source yields, those which haven't
+// been soft deleted, only those which have or all of them.
+type deletedRows int
+
+const (
+	liveRows deletedRows = iota
+	onlyDeletedRows
+	allRows
+)
+
+// liveRowsOf selects the rows reads of v's table yield, those which haven't
+// been soft deleted. Tables whose values can't soft delete have no tombstones,
+// so every row is yielded without looking one up.
+func liveRowsOf(v Value) deletedRows {
+	if _, ok := v.(SoftDeleteValue); ok {
+		return liveRows
+	}
+	return allRows
+}
+
+func (d deletedRows) keep(txn *badger.Txn, entries []kvs.Entry) (bool, error) {
+	if d == allRows {
+		return true, nil
+	}
+	ent := entries[0]
+	at, err := deletedAt(txn, ent.TableName, ent.OwnerUUID, ent.RowID)
+	if err != nil {
+		return false, err
+	}
+	return at.IsZero() == (d == liveRows), nil
+}
+
+func (s Store) softDeleteRow(txn *badger.Txn, owner kvs.UUID, value Value, rowID uint32) error {
+	blankEntries := kvs.ConvertToBlankEntries(value.TableName(), owner, rowID, value)
+	src := newListedRows(txn, []uint32{rowID}, blankEntries, nil, map[string]bool{}, liveRows)
+	_, entries, ok, err := src.next()
+	if err != nil || !ok {
+		return err
+	}
+
+	// the tombstone expires along with the row
+	e := badger.NewEntry(tombstoneKey(value.TableName(), owner, rowID), binary.BigEndian.AppendUint64(nil, uint64(time.Now().UnixNano())))
+	e.ExpiresAt = entries[0].ExpiresAt
+	if err := txn.SetEntry(e); err != nil {
+		return err
+	}
+	if err := s.writeRevision(txn, value.TableName(), owner, rowID, e.ExpiresAt); err != nil {
+		return err
+	}
+	return s.writeChange(txn, value.TableName(), owner, rowID, Deleted)
+}
+
+// Restore brings back a soft deleted row, ErrRowNotFound is returned if
+// there is no soft deleted row with the given ID.
+func (s Store) Restore(owner kvs.UUID, value Value, rowID uint32) error {
+	return s.update(func(txn *badger.Txn) error {
+		at, err := deletedAt(txn, value.TableName(), owner, rowID)
+		if err != nil {
+			return err
+		}
+		if at.IsZero() {
+			return fmt.Errorf("%w: no deleted row %d of %s", ErrRowNotFound, rowID, value.TableName())
+		}
+		key := tombstoneKey(value.TableName(), owner, rowID)
+		item, err := txn.Get(key)
+		if err != nil {
+			return err
+		}
+		if err := s.writeRevision(txn, value.TableName(), owner, rowID, item.ExpiresAt()); err != nil {
+			return err
+		}
+		if err := txn.Delete(key); err != nil {
+			return err
+		}
+		return s.writeChange(txn, value.TableName(), owner, rowID, Created)
+	})
+}
+
+// Purge removes every key of the given row for good, whether or not it was
+// soft deleted first.
+func (s Store) Purge(owner kvs.UUID, value Value, rowID uint32) error {
+	return s.update(func(txn *badger.Txn) error {
+		return s.deleteRow(txn, owner, value, rowID)
+	})
+}
+
+// LoadDeleted loads every soft deleted row of owner, in the order LoadAll
+// would return them were they not deleted.
+func LoadDeleted[T Value](s Store, owner kvs.UUID) ([]DeletedRow[T], error) {
+	tableName := (*new(T)).TableName()
+	blankEntries := kvs.ConvertToBlankEntries(tableName, owner, 0, *new(T))
+
+	dest := []DeletedRow[T]{}
+	err := s.view(func(txn *badger.Txn) error {
+		src := newMergedRows(txn, blankEntries, nil, nil, onlyDeletedRows)
+		_, err := eachRow(txn, owner, src, nil, Page{}, nil, func(row T) (bool, error) {
+			rowID, err := RowIDOf(row)
+			if err != nil {
+				return false, err
+			}
+			at, err := deletedAt(txn, tableName, owner, rowID)
+			if err != nil {
+				return false, err
+			}
+			dest = append(dest, DeletedRow[T]{Row: row, DeletedAt: at})
+			return true, nil
+		})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return dest, nil
+}
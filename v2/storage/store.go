@@ -32,163 +32,442 @@
 package storage
 
 import (
+	"errors"
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/dgraph-io/badger/v3"
 	"github.com/tauraamui/kvs/v2"
 )
 
+// ErrRowNotFound is returned when a row has no stored columns.
+var ErrRowNotFound = errors.New("row not found")
+
 type Value interface {
 	TableName() string
 }
 
+// EncodedValue can be implemented by a value to pick the encoding used for
+// its table, overriding the codec of the store and its KVDB. The table is
+// written with the codec registered for that encoding.
+type EncodedValue interface {
+	Value
+	Encoding() kvs.Encoding
+}
+
+// CodecValue can be implemented by a value to pick the codec used for its
+// table, overriding the codec of the store and its KVDB.
+type CodecValue interface {
+	Value
+	Codec() kvs.Codec
+}
+
 type Store struct {
-	db  kvs.KVDB
-	pks map[string]*badger.Sequence
+	db    kvs.KVDB
+	pks   map[string]*badger.Sequence
+	codec kvs.Codec
+	// encoding is set by WithEncoding, its codec is looked up on each write
+	// so codecs registered after the store was created can be used.
+	encoding *kvs.Encoding
+	// txn is set for a store bound to a Tx, every read and write then goes
+	// through it rather than a transaction of its own.
+	txn *badger.Txn
+	// tx is shared by every copy of a store bound to the same attempt at a
+	// Tx.
+	tx *txState
+	// changes and revisions are set by WithChanges and WithRevisions.
+	changes   bool
+	revisions bool
+}
+
+type Option func(*Store)
+
+// WithEncoding sets the encoding new and updated rows are written with, using
+// the codec registered for it in place of the KVDB's codec. Rows are always
+// read back with the encoding they were written with, so this can be changed
+// for an existing database.
+func WithEncoding(enc kvs.Encoding) Option {
+	return func(s *Store) {
+		s.codec, s.encoding = nil, &enc
+	}
 }
 
-func New(db kvs.KVDB) Store {
-	return Store{db: db, pks: map[string]*badger.Sequence{}}
+// WithCodec sets the codec new and updated rows are written with, in place of
+// the KVDB's codec. Rows are always read back with the codec they were written
+// with, so this can be changed for an existing database. Custom codecs have to
+// be registered with kvs.RegisterCodec, writes fail until they are.
+func WithCodec(c kvs.Codec) Option {
+	return func(s *Store) {
+		s.codec, s.encoding = c, nil
+	}
 }
 
+// WithChanges has every write record what kind of change it made, which Watch
+// needs to deliver it. It costs each write one more short lived key, so it is
+// only worth setting on stores whose writes are watched, Watch returns
+// ErrChangesNotRecorded for stores without it.
+func WithChanges() Option {
+	return func(s *Store) {
+		s.changes = true
+	}
+}
+
+// WithRevisions has every write record the time it was made at, which the
+// Time of History's revisions and LoadAsOf go by. It costs each write one
+// more key.
+func WithRevisions() Option {
+	return func(s *Store) {
+		s.revisions = true
+	}
+}
+
+func New(db kvs.KVDB, opts ...Option) Store {
+	s := Store{db: db, pks: map[string]*badger.Sequence{}}
+	for _, opt := range opts {
+		opt(&s)
+	}
+	return s
+}
+
+// codecFor resolves the codec v is written with, which has to be the one
+// registered for its encoding so that what it writes can be read back.
+func (s Store) codecFor(v Value) (kvs.Codec, error) {
+	c, err := s.selectCodec(v)
+	if err != nil {
+		return nil, err
+	}
+	if err := kvs.CheckCodec(c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (s Store) selectCodec(v Value) (kvs.Codec, error) {
+	if cv, ok := v.(CodecValue); ok {
+		return cv.Codec(), nil
+	}
+	if ev, ok := v.(EncodedValue); ok {
+		return kvs.CodecFor(ev.Encoding())
+	}
+	if s.encoding != nil {
+		return kvs.CodecFor(*s.encoding)
+	}
+	if s.codec != nil {
+		return s.codec, nil
+	}
+	return s.db.Codec(), nil
+}
+
+// Save writes every column of value as a new row in a single transaction.
+// The value's ID is only assigned once that transaction has committed, so on
+// error it is left as it was.
 func (s Store) Save(owner kvs.UUID, value Value) error {
 	rowID, err := nextRowID(s.db, owner, value.TableName(), s.pks)
 	if err != nil {
 		return err
 	}
 
-	return saveValue(s.db, value.TableName(), owner, rowID, value)
+	return saveValue(s, owner, rowID, value, true, 0)
 }
 
+// Update overwrites every column of the given row in a single transaction,
+// the same ID assignment rule as Save applies. If value has a version column
+// it must hold the row's stored version, or ErrStaleVersion is returned.
 func (s Store) Update(owner kvs.UUID, value Value, rowID uint32) error {
-	return saveValue(s.db, value.TableName(), owner, rowID, value)
+	return saveValue(s, owner, rowID, value, false, 0)
 }
 
-func saveValue(db kvs.KVDB, tableName string, ownerID kvs.UUID, rowID uint32, v Value) error {
+func saveValue(s Store, ownerID kvs.UUID, rowID uint32, v Value, create bool, ttl time.Duration) error {
 	if v == nil {
 		return nil
 	}
-	entries := kvs.ConvertToEntries(tableName, ownerID, rowID, v)
-	for _, e := range entries {
-		if err := kvs.Store(db, e); err != nil {
-			return err
+	codec, err := s.codecFor(v)
+	if err != nil {
+		return err
+	}
+	version, versioned := versionColumn(v)
+	if ttl == 0 {
+		ttl = ttlFor(v)
+	}
+
+	for attempt := 0; attempt < maxTxAttempts; attempt++ {
+		var previous any
+		err = s.update(func(txn *badger.Txn) error {
+			if versioned {
+				var err error
+				if previous, err = nextVersion(txn, ownerID, rowID, v, version, create); err != nil {
+					return err
+				}
+			}
+			kind := Updated
+			if create {
+				kind = Created
+			}
+			if err := s.writeChange(txn, v.TableName(), ownerID, rowID, kind); err != nil {
+				return err
+			}
+			if err := writeOwnership(txn, ownerID, v); err != nil {
+				return err
+			}
+			if err := writeValue(txn, ownerID, rowID, v, codec, expiresAt(ttl)); err != nil {
+				return err
+			}
+			return s.writeRevision(txn, v.TableName(), ownerID, rowID, expiresAt(ttl))
+		})
+		if previous != nil {
+			restore := func() error {
+				return kvs.SetColumnValue(v, version.Name, previous)
+			}
+			if err != nil {
+				if err := restore(); err != nil {
+					return err
+				}
+			} else {
+				// within a Tx the version is only kept if it commits
+				s.undoTx(restore)
+			}
+		}
+		// a conflicting write may have moved the version on, which only
+		// checking it again can tell
+		if !versioned || !errors.Is(err, badger.ErrConflict) {
+			break
 		}
 	}
+	if err != nil {
+		return err
+	}
 
 	return kvs.LoadID(v, rowID)
 }
 
+// writeValue writes every key of the row, all of them expiring at expiresAt
+// so the row expires as a whole.
+func writeValue(txn *badger.Txn, ownerID kvs.UUID, rowID uint32, v Value, codec kvs.Codec, expiresAt uint64) error {
+	entries, err := kvs.ConvertToEntriesWithCodec(v.TableName(), ownerID, rowID, v, codec)
+	if err != nil {
+		return err
+	}
+
+	if err := writeUniqueClaims(txn, ownerID, rowID, v, expiresAt); err != nil {
+		return err
+	}
+	if err := writeIndexes(txn, ownerID, rowID, v, expiresAt); err != nil {
+		return err
+	}
+	if err := writeElements(txn, ownerID, rowID, v, codec, expiresAt); err != nil {
+		return err
+	}
+	if err := deleteLegacyStructs(txn, ownerID, rowID, v); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		e.ExpiresAt = expiresAt
+		if err := kvs.StoreTxn(txn, e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Delete removes every column of the given row in a single transaction. Rows
+// of tables whose values implement SoftDeleteValue are only marked as deleted,
+// Purge removes those for good.
 func (s Store) Delete(owner kvs.UUID, value Value, rowID uint32) error {
-	db := s.db
+	return s.update(func(txn *badger.Txn) error {
+		if softDeletes(value) {
+			return s.softDeleteRow(txn, owner, value, rowID)
+		}
+		return s.deleteRow(txn, owner, value, rowID)
+	})
+}
 
-	blankEntries := kvs.ConvertToBlankEntries(value.TableName(), owner, rowID, value)
-	for _, ent := range blankEntries {
-		db.Update(func(txn *badger.Txn) error {
-			return txn.Delete(ent.Key())
-		})
+func (s Store) deleteRow(txn *badger.Txn, owner kvs.UUID, value Value, rowID uint32) error {
+	if err := deleteUniqueClaims(txn, owner, rowID, value); err != nil {
+		return err
+	}
+	if err := deleteIndexes(txn, owner, rowID, value); err != nil {
+		return err
+	}
+	if err := deleteElements(txn, owner, rowID, value); err != nil {
+		return err
 	}
 
-	return nil
+	// a row which was soft deleted already looked deleted to watchers
+	deleted, err := deletedAt(txn, value.TableName(), owner, rowID)
+	if err != nil {
+		return err
+	}
+	if deleted.IsZero() {
+		if err := s.writeChange(txn, value.TableName(), owner, rowID, Deleted); err != nil {
+			return err
+		}
+	} else if err := txn.Delete(tombstoneKey(value.TableName(), owner, rowID)); err != nil {
+		return err
+	}
+	if s.revisions {
+		if err := txn.SetEntry(removedRevision(value.TableName(), owner, rowID)); err != nil {
+			return err
+		}
+	}
+
+	for _, ent := range kvs.ConvertToBlankEntries(value.TableName(), owner, rowID, value) {
+		if err := kvs.DeleteTxn(txn, ent); err != nil {
+			return err
+		}
+	}
+	return deleteLegacyStructs(txn, owner, rowID, value)
 }
 
+// Load reads the given row into dest in a single transaction. Columns the row
+// has no stored entry for, such as fields added after it was saved, are set
+// to their zero value. ErrRowNotFound is returned if it has no columns at all.
 func Load[T Value](s Store, dest T, owner kvs.UUID, rowID uint32) error {
-	db := s.db
+	return s.view(func(txn *badger.Txn) error {
+		src := newListedRows(txn, []uint32{rowID}, kvs.ConvertToBlankEntries(dest.TableName(), owner, rowID, dest), nil, nil, liveRowsOf(dest))
+		_, entries, ok, err := src.next()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("%w: row %d of %s", ErrRowNotFound, rowID, dest.TableName())
+		}
 
-	blankEntries := kvs.ConvertToBlankEntries(dest.TableName(), owner, rowID, dest)
-	for _, ent := range blankEntries {
-		db.View(func(txn *badger.Txn) error {
-			item, err := txn.Get(ent.Key())
-			if err != nil {
+		present := map[string]bool{}
+		for _, ent := range entries {
+			if err := kvs.LoadEntry(dest, ent); err != nil {
 				return err
 			}
-
-			if err := item.Value(func(val []byte) error {
-				ent.Data = val
-				return nil
-			}); err != nil {
-				return err
+			present[ent.ColumnName] = true
+		}
+		for _, c := range kvs.Columns(dest) {
+			if !present[c.Name] {
+				if err := kvs.SetColumnValue(dest, c.Name, nil); err != nil {
+					return err
+				}
 			}
+		}
 
-			return nil
-		})
+		legacy := kvs.ConvertToLegacyEntries(dest.TableName(), owner, rowID, dest)
+		if err := loadLegacyStructs(txn, legacy, rowID, dest, present, nil); err != nil {
+			return err
+		}
+		if err := loadElements(txn, dest.TableName(), owner, rowID, dest, present); err != nil {
+			return err
+		}
+		if rowExpired(entries) {
+			return fmt.Errorf("%w: row %d of %s", ErrRowNotFound, rowID, dest.TableName())
+		}
+		return kvs.LoadID(dest, rowID)
+	})
+}
 
-		ent.RowID = rowID
+// loadLegacyStructs fills dest's flattened struct fields from the rows' legacy
+// entries, which hold each struct whole for rows saved before structs were
+// flattened. Structs the row has any flattened column stored for are left
+// alone, as are those whose columns load leaves out, unless it is nil.
+// Evaluators only see the flattened columns, so a legacy row only matches
+// filters on its struct's fields once it has been written again.
+func loadLegacyStructs(txn *badger.Txn, legacy []kvs.Entry, rowID uint32, dest any, present, load map[string]bool) error {
+	for _, ent := range legacy {
+		flattened, wanted := false, load == nil
+		for _, c := range kvs.Columns(dest) {
+			if strings.HasPrefix(c.Name, ent.ColumnName+".") {
+				flattened = flattened || present[c.Name]
+				wanted = wanted || load[c.Name]
+			}
+		}
+		if flattened || !wanted {
+			continue
+		}
 
+		ent.RowID = rowID
+		item, err := txn.Get(ent.Key())
+		if err != nil {
+			if errors.Is(err, badger.ErrKeyNotFound) {
+				continue
+			}
+			return err
+		}
+		if err := loadItemDataIntoEntry(&ent, item.Value); err != nil {
+			return err
+		}
+		ent.Meta = item.UserMeta()
 		if err := kvs.LoadEntry(dest, ent); err != nil {
 			return err
 		}
 	}
-
-	return kvs.LoadID(dest, rowID)
+	return nil
 }
 
-func extractRowFromKey(k string) (int, error) {
-	rowPos := strings.LastIndex(k, ".")
-	return strconv.Atoi(k[rowPos+1:])
+// deleteLegacyStructs removes the legacy entries of the row, which would
+// otherwise be left behind once it has been written with flattened columns.
+func deleteLegacyStructs(txn *badger.Txn, owner kvs.UUID, rowID uint32, v Value) error {
+	for _, ent := range kvs.ConvertToLegacyEntries(v.TableName(), owner, rowID, v) {
+		if _, err := txn.Get(ent.Key()); err != nil {
+			if errors.Is(err, badger.ErrKeyNotFound) {
+				continue
+			}
+			return err
+		}
+		if err := kvs.DeleteTxn(txn, ent); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func LoadAll[T Value](s Store, owner kvs.UUID) ([]T, error) {
-	return loadAllWithPredicate[T](s, owner, func(e kvs.Entry) bool { return true })
+	dest, _, err := LoadPage[T](s, owner, Page{})
+	return dest, err
 }
 
 func LoadAllWithEvaluator[T Value](s Store, owner kvs.UUID, pred func(e kvs.Entry) bool) ([]T, error) {
-	return loadAllWithPredicate[T](s, owner, pred)
+	return LoadAllWithErrorEvaluator[T](s, owner, func(e kvs.Entry) (bool, error) {
+		return pred(e), nil
+	})
 }
 
-func loadAllWithPredicate[T Value](s Store, owner kvs.UUID, pred func(e kvs.Entry) bool) ([]T, error) {
-	db := s.db
-	dest := []T{}
-	v := *new(T)
-
-	exclusions := map[int]int{}
-
-	blankEntries := kvs.ConvertToBlankEntries(v.TableName(), owner, 0, v)
-	for _, ent := range blankEntries {
-		// iterate over all stored values for this entry
-		prefix := ent.PrefixKey()
-		if err := db.View(func(txn *badger.Txn) error {
-			it := txn.NewIterator(badger.DefaultIteratorOptions)
-			defer it.Close()
-
-			var destinationindex uint32 = 0
-			for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
-				if _, ok := exclusions[int(destinationindex)]; ok {
-					destinationindex++
-					continue
-				}
-
-				item := it.Item()
-				if err := loadItemDataIntoEntry(&ent, item.Value); err != nil {
-					return err
-				}
+// LoadAllWithErrorEvaluator is LoadAllWithEvaluator with an evaluator which can
+// fail, its error is returned as soon as it has one.
+func LoadAllWithErrorEvaluator[T Value](s Store, owner kvs.UUID, pred func(e kvs.Entry) (bool, error)) ([]T, error) {
+	dest, _, err := LoadPageWithEvaluator[T](s, owner, pred, Page{})
+	return dest, err
+}
 
-				if err := forEachEntryItem(destinationindex, ent, item.Key(), &dest, &exclusions, pred); err != nil {
-					return err
-				}
+// LoadRowsWithEvaluator loads only the given rows of owner, in the same order
+// LoadAll would return them, skipping rows which have no stored columns or
+// which have an entry the evaluator rejects.
+func LoadRowsWithEvaluator[T Value](s Store, owner kvs.UUID, rowIDs []uint32, pred func(e kvs.Entry) (bool, error)) ([]T, error) {
+	dest, _, err := LoadRowsPageWithEvaluator[T](s, owner, rowIDs, pred, Page{})
+	return dest, err
+}
 
-				destinationindex++
-			}
-			return nil
-		}); err != nil {
-			return nil, err
-		}
+// RowIDOf returns the row ID assigned to the ID field of v.
+func RowIDOf(v any) (uint32, error) {
+	rowID, err := kvs.ColumnValue(v, "ID")
+	if err != nil {
+		return 0, err
 	}
-
-	finalDest := []T{}
-	for i, v := range dest {
-		if _, ok := exclusions[i]; ok {
-			continue
-		}
-		finalDest = append(finalDest, v)
+	id, ok := rowID.(uint32)
+	if !ok {
+		return 0, errors.New("struct field ID is not of type uint32")
 	}
+	return id, nil
+}
 
-	return finalDest, nil
+// sortRowIDs orders row IDs the way they are laid out in the keyspace,
+// which is by their decimal representation rather than their value.
+func sortRowIDs(ids []uint32) {
+	sort.Slice(ids, func(i, j int) bool {
+		return strconv.FormatUint(uint64(ids[i]), 10) < strconv.FormatUint(uint64(ids[j]), 10)
+	})
 }
 
 func (s Store) Close() (err error) {
-	if s.pks == nil {
+	if s.pks == nil || s.txn != nil {
 		return
 	}
 	for _, seq := range s.pks {
@@ -206,40 +485,10 @@ func (s Store) Close() (err error) {
 	return
 }
 
-func forEachEntryItem[T Value](index uint32, ent kvs.Entry, key []byte, dest *[]T, exclusions *map[int]int, pred func(e kvs.Entry) bool) error {
-	if len(*dest) == 0 || index >= uint32(len(*dest)) {
-		rowID, err := extractRowFromKey(string(key))
-		if err != nil {
-			return err
-		}
-
-		*dest = append(*dest, *new(T))
-
-		// for reasons, we have to just keep assigning the current "field we're on" as the full entry's ID
-		if err := kvs.LoadID(&(*dest)[index], uint32(rowID)); err != nil {
-			return err
-		}
-	}
-
-	ent.RowID = index
-
-	excluded := false
-	if pred != nil && !pred(ent) {
-		(*exclusions)[int(index)] = int(index)
-		excluded = true
-	}
-
-	if !excluded {
-		if err := kvs.LoadEntry(&(*dest)[index], ent); err != nil {
-			return err
-		}
-	}
-	return nil
-}
-
 func loadItemDataIntoEntry(ent *kvs.Entry, fn func(func(val []byte) error) error) error {
 	return fn(func(val []byte) error {
-		ent.Data = val
+		// val is only valid until the callback returns
+		ent.Data = append([]byte{}, val...)
 		return nil
 	})
 }
@@ -32,8 +32,18 @@
 package storage_test
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/dgraph-io/badger/v3"
+	"github.com/google/uuid"
 	"github.com/matryer/is"
 	"github.com/tauraamui/kvs/v2"
 	"github.com/tauraamui/kvs/v2/storage"
@@ -228,3 +238,1588 @@ func TestStoreMultipleBalloonsAndCakesInSuccessionRetainsCorrectRowIDs(t *testin
 	is.Equal(mediumWhiteBalloon.ID, uint32(2))
 	is.Equal(redVelvetCake.ID, uint32(2))
 }
+
+type Kite struct {
+	ID    uint32 `mdb:"ignore"`
+	Color string
+	Wind  float64
+}
+
+func (k Kite) TableName() string { return "kites" }
+
+func TestStoreSaveWithUnencodableFieldWritesNothingAndLeavesIDUnchanged(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	kite := Kite{ID: 99, Color: "GREEN", Wind: math.NaN()}
+	is.True(store.Save(kvs.RootOwner{}, &kite) != nil) // save must fail to encode NaN field
+	is.Equal(kite.ID, uint32(99))
+
+	ks, err := storage.LoadAll[Kite](store, kvs.RootOwner{})
+	is.NoErr(err)
+	is.Equal(len(ks), 0) // no partial columns should have been written
+}
+
+func TestStoreFailedUpdateLeavesStoredRowUntouched(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	kite := Kite{Color: "GREEN"}
+	is.NoErr(store.Save(kvs.RootOwner{}, &kite))
+
+	kite.Color = "ORANGE"
+	kite.Wind = math.NaN()
+	is.True(store.Update(kvs.RootOwner{}, &kite, kite.ID) != nil)
+
+	loaded := Kite{}
+	is.NoErr(storage.Load(store, &loaded, kvs.RootOwner{}, kite.ID))
+	is.Equal(loaded.Color, "GREEN")
+}
+
+type Blimp struct {
+	ID       uint32 `mdb:"ignore"`
+	Name     string
+	Altitude int
+	Heading  float64
+	Flying   bool
+}
+
+func (b Blimp) TableName() string { return "blimps" }
+
+type OrderedBlimp Blimp
+
+func (b OrderedBlimp) TableName() string { return "orderedblimps" }
+func (b OrderedBlimp) Codec() kvs.Codec  { return kvs.OrderedCodec{} }
+
+type BinaryBlimp Blimp
+
+func (b BinaryBlimp) TableName() string      { return "binaryblimps" }
+func (b BinaryBlimp) Encoding() kvs.Encoding { return kvs.BinaryEncoding }
+
+func TestStoreWithOrderedCodecSaveAndLoadSuccess(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db, storage.WithCodec(kvs.OrderedCodec{}))
+	defer store.Close()
+
+	is.NoErr(store.Save(kvs.RootOwner{}, &Blimp{Name: "GOODYEAR", Altitude: -12, Heading: 270.5, Flying: true}))
+	is.NoErr(store.Save(kvs.RootOwner{}, &Blimp{Name: "HINDENBURG", Altitude: 3000, Heading: -1.25}))
+
+	bs, err := storage.LoadAll[Blimp](store, kvs.RootOwner{})
+	is.NoErr(err)
+	is.Equal(bs, []Blimp{
+		{ID: 0, Name: "GOODYEAR", Altitude: -12, Heading: 270.5, Flying: true},
+		{ID: 1, Name: "HINDENBURG", Altitude: 3000, Heading: -1.25},
+	})
+
+	b := Blimp{}
+	is.NoErr(storage.Load(store, &b, kvs.RootOwner{}, 1))
+	is.Equal(b, Blimp{ID: 1, Name: "HINDENBURG", Altitude: 3000, Heading: -1.25})
+}
+
+func TestStoreWithEncodingUsesRegisteredCodec(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db, storage.WithEncoding(kvs.OrderedEncoding))
+	defer store.Close()
+
+	is.NoErr(store.Save(kvs.RootOwner{}, &Blimp{Name: "GOODYEAR", Altitude: -12}))
+	is.NoErr(store.Save(kvs.RootOwner{}, &BinaryBlimp{Name: "HINDENBURG", Altitude: 3000}))
+
+	e := kvs.Entry{TableName: "blimps", ColumnName: "altitude", OwnerUUID: kvs.RootOwner{}, RowID: 0}
+	is.NoErr(kvs.Get(db, &e))
+	is.Equal(kvs.Encoding(e.Meta), kvs.OrderedEncoding)
+
+	e = kvs.Entry{TableName: "binaryblimps", ColumnName: "altitude", OwnerUUID: kvs.RootOwner{}, RowID: 0}
+	is.NoErr(kvs.Get(db, &e))
+	is.Equal(kvs.Encoding(e.Meta), kvs.BinaryEncoding) // the table's encoding wins over the store's
+
+	bs, err := storage.LoadAll[BinaryBlimp](store, kvs.RootOwner{})
+	is.NoErr(err)
+	is.Equal(bs, []BinaryBlimp{{ID: 0, Name: "HINDENBURG", Altitude: 3000}})
+
+	unknown := storage.New(db, storage.WithEncoding(kvs.Encoding(99)))
+	defer unknown.Close()
+	is.True(unknown.Save(kvs.RootOwner{}, &Blimp{Name: "R101"}) != nil) // encodings without a codec can't be written
+}
+
+func TestStoreWithOrderedCodecReadsExistingJSONRows(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	jsonStore := storage.New(db)
+	is.NoErr(jsonStore.Save(kvs.RootOwner{}, &Blimp{Name: "OLD", Altitude: 40}))
+	is.NoErr(jsonStore.Close())
+
+	store := storage.New(db, storage.WithCodec(kvs.OrderedCodec{}))
+	defer store.Close()
+	is.NoErr(store.Save(kvs.RootOwner{}, &Blimp{Name: "NEW", Altitude: 80}))
+
+	bs, err := storage.LoadAll[Blimp](store, kvs.RootOwner{})
+	is.NoErr(err)
+	is.Equal(len(bs), 2)
+	is.Equal(bs[0].Altitude, 40)
+	is.Equal(bs[1].Altitude, 80)
+}
+
+func TestStoreValueCodecOverridesStoreCodec(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	is.NoErr(store.Save(kvs.RootOwner{}, &OrderedBlimp{Name: "TABLE", Altitude: 5}))
+
+	e := kvs.Entry{TableName: "orderedblimps", ColumnName: "altitude", OwnerUUID: kvs.RootOwner{}, RowID: 0}
+	is.NoErr(kvs.Get(db, &e))
+	is.Equal(kvs.Encoding(e.Meta), kvs.OrderedEncoding)
+	is.Equal(len(e.Data), 8)
+
+	bs, err := storage.LoadAll[OrderedBlimp](store, kvs.RootOwner{})
+	is.NoErr(err)
+	is.Equal(bs, []OrderedBlimp{{ID: 0, Name: "TABLE", Altitude: 5}})
+}
+
+type Passenger struct {
+	ID      uint32 `mdb:"ignore"`
+	Name    string `mdb:"index"`
+	Age     int    `mdb:"index"`
+	Married bool
+}
+
+func (p Passenger) TableName() string { return "passengers" }
+
+func scanIndex(is *is.I, store storage.Store, column string) map[string][]uint32 {
+	found := map[string][]uint32{}
+	is.NoErr(storage.ScanIndex[Passenger](store, kvs.RootOwner{}, column, nil, func(value []byte, rowID uint32) (bool, error) {
+		found[string(value)] = append(found[string(value)], rowID)
+		return true, nil
+	}))
+	return found
+}
+
+func TestStoreIndexesFollowSaveUpdateAndDelete(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	amy := Passenger{Name: "Amy", Age: 26}
+	brian := Passenger{Name: "Brian", Age: 3}
+	is.NoErr(store.Save(kvs.RootOwner{}, &amy))
+	is.NoErr(store.Save(kvs.RootOwner{}, &brian))
+
+	is.Equal(scanIndex(is, store, "name"), map[string][]uint32{"Amy": {0}, "Brian": {1}})
+
+	amy.Name = "Amelia"
+	is.NoErr(store.Update(kvs.RootOwner{}, &amy, amy.ID))
+	is.Equal(scanIndex(is, store, "name"), map[string][]uint32{"Amelia": {0}, "Brian": {1}})
+
+	is.NoErr(store.Delete(kvs.RootOwner{}, &brian, brian.ID))
+	is.Equal(scanIndex(is, store, "name"), map[string][]uint32{"Amelia": {0}})
+	is.Equal(len(scanIndex(is, store, "age")), 1)
+}
+
+// UntaggedPassenger writes the passengers table without maintaining its indexes.
+type UntaggedPassenger struct {
+	ID      uint32 `mdb:"ignore"`
+	Name    string
+	Age     int
+	Married bool
+}
+
+func (p UntaggedPassenger) TableName() string { return "passengers" }
+
+func TestStoreReindexReplacesStaleEntries(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	amy := Passenger{Name: "Amy", Age: 26}
+	is.NoErr(store.Save(kvs.RootOwner{}, &amy))
+	is.NoErr(store.Save(kvs.RootOwner{}, &UntaggedPassenger{Name: "Brian", Age: 3}))
+	is.NoErr(store.Update(kvs.RootOwner{}, &UntaggedPassenger{Name: "Amelia", Age: 27}, amy.ID))
+
+	// the index still holds amy's old values and is missing brian
+	is.Equal(scanIndex(is, store, "name"), map[string][]uint32{"Amy": {0}})
+
+	is.NoErr(storage.Reindex[Passenger](store, kvs.RootOwner{}))
+	is.Equal(scanIndex(is, store, "name"), map[string][]uint32{"Amelia": {0}, "Brian": {1}})
+	is.Equal(len(scanIndex(is, store, "age")), 2)
+}
+
+func TestStoreReindexTablesTooLargeForOneTransaction(t *testing.T) {
+	is := is.New(t)
+
+	// a small memtable keeps the transaction size limit low
+	bdb, err := badger.Open(badger.DefaultOptions("").WithLogger(nil).WithInMemory(true).WithMemTableSize(1 << 20).WithValueThreshold(1 << 10))
+	is.NoErr(err)
+	db, err := kvs.NewKVDB(bdb)
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	const rows = 20000
+	wb := bdb.NewWriteBatch()
+	for i := 0; i < rows; i++ {
+		entries, err := kvs.ConvertToEntries("passengers", kvs.RootOwner{}, uint32(i), UntaggedPassenger{Name: "Amy", Age: i})
+		is.NoErr(err)
+		for _, e := range entries {
+			is.NoErr(wb.SetEntry(badger.NewEntry(e.Key(), e.Data).WithMeta(e.Meta)))
+		}
+	}
+	is.NoErr(wb.Flush())
+
+	// rewriting every index key at once is more than one transaction holds
+	is.True(errors.Is(bdb.Update(func(txn *badger.Txn) error {
+		for i := 0; i < rows; i++ {
+			if err := txn.Set([]byte(fmt.Sprintf("_idx.passengers.root.age.%d.%d", i, i)), nil); err != nil {
+				return err
+			}
+			if err := txn.Set([]byte(fmt.Sprintf("_idx.passengers.root.name.Amy.%d", i)), nil); err != nil {
+				return err
+			}
+		}
+		return errors.New("not too big")
+	}), badger.ErrTxnTooBig))
+
+	is.NoErr(storage.Reindex[Passenger](store, kvs.RootOwner{}))
+	is.Equal(len(scanIndex(is, store, "name")["Amy"]), rows)
+	is.Equal(len(scanIndex(is, store, "age")), rows)
+}
+
+func TestStoreIndexScanIsInValueOrder(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	for _, age := range []int{58, -1, 27, 3, 1000} {
+		is.NoErr(store.Save(kvs.RootOwner{}, &Passenger{Age: age}))
+	}
+
+	ages := []int{}
+	is.NoErr(storage.ScanIndex[Passenger](store, kvs.RootOwner{}, "age", nil, func(value []byte, rowID uint32) (bool, error) {
+		p := Passenger{}
+		is.NoErr(storage.Load(store, &p, kvs.RootOwner{}, rowID))
+		ages = append(ages, p.Age)
+		return true, nil
+	}))
+	is.Equal(ages, []int{-1, 3, 27, 58, 1000})
+}
+
+type Pilot struct {
+	ID      uint32 `mdb:"ignore"`
+	Email   string `mdb:"unique"`
+	License int    `mdb:"unique,global"`
+}
+
+func (p Pilot) TableName() string { return "pilots" }
+
+func TestStoreUniqueColumnRejectsDuplicatePerOwner(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	is.NoErr(store.Save(kvs.RootOwner{}, &Pilot{Email: "amy@example.com", License: 1}))
+
+	duplicate := Pilot{ID: 42, Email: "amy@example.com", License: 2}
+	err = store.Save(kvs.RootOwner{}, &duplicate)
+	is.True(errors.Is(err, storage.ErrUniqueViolation))
+	is.Equal(duplicate.ID, uint32(42))
+
+	ps, err := storage.LoadAll[Pilot](store, kvs.RootOwner{})
+	is.NoErr(err)
+	is.Equal(len(ps), 1) // rejected row must not have been written
+
+	// the same email is fine for a different owner
+	is.NoErr(store.Save(uuid.New(), &Pilot{Email: "amy@example.com", License: 3}))
+}
+
+func TestStoreGlobalUniqueColumnRejectsDuplicateAcrossOwners(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	is.NoErr(store.Save(uuid.New(), &Pilot{Email: "amy@example.com", License: 7}))
+	is.True(errors.Is(store.Save(uuid.New(), &Pilot{Email: "bob@example.com", License: 7}), storage.ErrUniqueViolation))
+}
+
+func TestStoreUniqueColumnFollowsUpdateAndDelete(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	amy := Pilot{Email: "amy@example.com", License: 1}
+	bob := Pilot{Email: "bob@example.com", License: 2}
+	is.NoErr(store.Save(kvs.RootOwner{}, &amy))
+	is.NoErr(store.Save(kvs.RootOwner{}, &bob))
+
+	// re-saving a row with its own values is not a violation
+	is.NoErr(store.Update(kvs.RootOwner{}, &amy, amy.ID))
+
+	bob.Email = "amy@example.com"
+	is.True(errors.Is(store.Update(kvs.RootOwner{}, &bob, bob.ID), storage.ErrUniqueViolation))
+
+	amy.Email = "amelia@example.com"
+	is.NoErr(store.Update(kvs.RootOwner{}, &amy, amy.ID))
+	is.NoErr(store.Update(kvs.RootOwner{}, &bob, bob.ID)) // amy's old email has been released
+
+	is.NoErr(store.Delete(kvs.RootOwner{}, &amy, amy.ID))
+	is.NoErr(store.Save(kvs.RootOwner{}, &Pilot{Email: "amelia@example.com", License: 1}))
+}
+
+func TestStoreUsesKVDBCodecUnlessOverridden(t *testing.T) {
+	is := is.New(t)
+
+	mdb, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer mdb.Close()
+	db := mdb.WithCodec(kvs.GobCodec{})
+
+	store := storage.New(db)
+	defer store.Close()
+	is.NoErr(store.Save(kvs.RootOwner{}, &Blimp{Name: "GOB", Altitude: 10}))
+
+	binaryStore := storage.New(db, storage.WithCodec(kvs.BinaryCodec{}))
+	defer binaryStore.Close()
+	is.NoErr(binaryStore.Save(kvs.RootOwner{}, &Blimp{Name: "BINARY", Altitude: 20}))
+
+	encodings := []kvs.Encoding{}
+	for _, rowID := range []uint32{0, 1} {
+		e := kvs.Entry{TableName: "blimps", ColumnName: "altitude", OwnerUUID: kvs.RootOwner{}, RowID: rowID}
+		is.NoErr(kvs.Get(db, &e))
+		encodings = append(encodings, kvs.Encoding(e.Meta))
+	}
+	is.Equal(encodings, []kvs.Encoding{kvs.GobEncoding, kvs.BinaryEncoding})
+
+	bs, err := storage.LoadAll[Blimp](store, kvs.RootOwner{})
+	is.NoErr(err)
+	is.Equal(bs, []Blimp{{ID: 0, Name: "GOB", Altitude: 10}, {ID: 1, Name: "BINARY", Altitude: 20}})
+}
+
+// customJSONCodec is JSON under a custom encoding.
+type customJSONCodec struct {
+	kvs.JSONCodec
+	enc kvs.Encoding
+}
+
+func (c customJSONCodec) Encoding() kvs.Encoding { return c.enc }
+
+// unusedEncoding returns a custom encoding no codec is registered for, as
+// registrations last for the rest of the test binary's run.
+func unusedEncoding(is *is.I) kvs.Encoding {
+	for enc := kvs.FirstCustomEncoding; enc <= 127; enc++ {
+		if _, err := kvs.CodecFor(enc); err != nil {
+			return enc
+		}
+	}
+	is.Fail() // every custom encoding is taken
+	return 0
+}
+
+func TestStoreRejectsUnregisteredCodec(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	codec := customJSONCodec{enc: unusedEncoding(is)}
+	store := storage.New(db, storage.WithCodec(codec))
+	defer store.Close()
+
+	is.True(store.Save(kvs.RootOwner{}, &Blimp{Name: "UNREADABLE"}) != nil) // it couldn't be loaded again
+	bs, err := storage.LoadAll[Blimp](store, kvs.RootOwner{})
+	is.NoErr(err)
+	is.Equal(len(bs), 0)
+
+	is.NoErr(kvs.RegisterCodec(codec))
+	is.NoErr(store.Save(kvs.RootOwner{}, &Blimp{Name: "READABLE"}))
+	bs, err = storage.LoadAll[Blimp](store, kvs.RootOwner{})
+	is.NoErr(err)
+	is.Equal(len(bs), 1)
+	is.Equal(bs[0].Name, "READABLE")
+}
+
+type Post struct {
+	ID     uint32 `mdb:"ignore"`
+	Title  string
+	Tags   []string       `mdb:"expand"`
+	Scores map[int]string `mdb:"expand"`
+}
+
+func (p Post) TableName() string { return "posts" }
+
+func TestStoreExpandedColumnsSaveAndLoad(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	first := Post{Title: "first", Tags: []string{"go", "kv", "badger"}, Scores: map[int]string{-3: "low", 10: "high"}}
+	second := Post{Title: "second"}
+	is.NoErr(store.Save(kvs.RootOwner{}, &first))
+	is.NoErr(store.Save(kvs.RootOwner{}, &second))
+
+	tag := kvs.Entry{TableName: "posts", ColumnName: "tags", OwnerUUID: kvs.RootOwner{}, RowID: first.ID}
+	is.NoErr(kvs.Get(db, &tag))
+	is.Equal(kvs.Encoding(tag.Meta), kvs.ExpandedEncoding)
+	is.Equal(len(tag.Data), 0)
+
+	loaded := Post{}
+	is.NoErr(storage.Load(store, &loaded, kvs.RootOwner{}, first.ID))
+	is.Equal(loaded, first)
+
+	posts, err := storage.LoadAll[Post](store, kvs.RootOwner{})
+	is.NoErr(err)
+	is.Equal(posts, []Post{first, second})
+
+	first.Tags = []string{"kv"}
+	is.NoErr(store.Update(kvs.RootOwner{}, &first, first.ID))
+	is.NoErr(storage.Load(store, &loaded, kvs.RootOwner{}, first.ID))
+	is.Equal(loaded.Tags, []string{"kv"})
+}
+
+func TestStoreExpandedColumnElementUpdates(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	post := Post{Title: "post", Tags: []string{"a", "b"}}
+	is.NoErr(store.Save(kvs.RootOwner{}, &post))
+
+	is.NoErr(storage.AppendElements[Post](store, kvs.RootOwner{}, post.ID, "tags", "c", "b"))
+	removed, err := storage.RemoveElements[Post](store, kvs.RootOwner{}, post.ID, "tags", "b")
+	is.NoErr(err)
+	is.Equal(removed, 2)
+	is.NoErr(storage.AppendElements[Post](store, kvs.RootOwner{}, post.ID, "tags", "d"))
+
+	is.NoErr(storage.SetElement[Post](store, kvs.RootOwner{}, post.ID, "scores", 2, "two"))
+	is.NoErr(storage.SetElement[Post](store, kvs.RootOwner{}, post.ID, "scores", 1, "one"))
+	is.NoErr(storage.SetElement[Post](store, kvs.RootOwner{}, post.ID, "scores", 2, "deux"))
+	removed, err = storage.RemoveElements[Post](store, kvs.RootOwner{}, post.ID, "scores", 1, 5)
+	is.NoErr(err)
+	is.Equal(removed, 1)
+
+	loaded := Post{}
+	is.NoErr(storage.Load(store, &loaded, kvs.RootOwner{}, post.ID))
+	is.Equal(loaded.Tags, []string{"a", "c", "d"})
+	is.Equal(loaded.Scores, map[int]string{2: "deux"})
+
+	is.True(storage.AppendElements[Post](store, kvs.RootOwner{}, post.ID, "tags", 1) != nil)
+	is.True(storage.AppendElements[Post](store, kvs.RootOwner{}, post.ID, "title", "x") != nil)
+	is.True(errors.Is(storage.AppendElements[Post](store, kvs.RootOwner{}, 99, "tags", "x"), storage.ErrRowNotFound))
+
+	is.NoErr(store.Delete(kvs.RootOwner{}, &post, post.ID))
+	is.NoErr(db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		prefix := []byte("_elem.")
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			t.Errorf("element %q left behind after delete", it.Item().Key())
+		}
+		return nil
+	}))
+}
+
+func TestStoreLoadPageWithCursor(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	for i := 0; i < 12; i++ {
+		is.NoErr(store.Save(kvs.RootOwner{}, &Balloon{Color: "RED", Size: i}))
+	}
+
+	sizes := func(bs []Balloon) []int {
+		s := []int{}
+		for _, b := range bs {
+			s = append(s, b.Size)
+		}
+		return s
+	}
+
+	// rows are paged in key order, which puts row 10 before row 2
+	page, cursor, err := storage.LoadPage[Balloon](store, kvs.RootOwner{}, storage.Page{Limit: 4})
+	is.NoErr(err)
+	is.Equal(sizes(page), []int{0, 1, 10, 11})
+	is.True(cursor != "")
+
+	// rows saved after the cursor was handed out don't shift the next page
+	is.NoErr(store.Save(kvs.RootOwner{}, &Balloon{Color: "BLUE", Size: 12}))
+
+	page, cursor, err = storage.LoadPage[Balloon](store, kvs.RootOwner{}, storage.Page{Limit: 4, After: cursor})
+	is.NoErr(err)
+	is.Equal(sizes(page), []int{12, 2, 3, 4})
+
+	page, cursor, err = storage.LoadPage[Balloon](store, kvs.RootOwner{}, storage.Page{Offset: 1, After: cursor})
+	is.NoErr(err)
+	is.Equal(sizes(page), []int{6, 7, 8, 9})
+	is.Equal(cursor, storage.Cursor(""))
+
+	_, _, err = storage.LoadPage[Balloon](store, kvs.RootOwner{}, storage.Page{After: "not a cursor"})
+	is.True(errors.Is(err, storage.ErrInvalidCursor))
+}
+
+func TestStoreLoadAllColumnsOnlyLoadsSelectedColumns(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	is.NoErr(store.Save(kvs.RootOwner{}, &Post{Title: "first", Tags: []string{"a"}, Scores: map[int]string{1: "one"}}))
+	is.NoErr(store.Save(kvs.RootOwner{}, &Post{Title: "second", Tags: []string{"b"}}))
+
+	posts, err := storage.LoadAllColumns[Post](store, kvs.RootOwner{}, "Title")
+	is.NoErr(err)
+	is.Equal(posts, []Post{{ID: 0, Title: "first"}, {ID: 1, Title: "second"}})
+
+	posts, err = storage.LoadAllColumns[Post](store, kvs.RootOwner{}, "tags")
+	is.NoErr(err)
+	is.Equal(posts, []Post{{ID: 0, Tags: []string{"a"}}, {ID: 1, Tags: []string{"b"}}})
+
+	_, err = storage.LoadAllColumns[Post](store, kvs.RootOwner{}, "body")
+	is.True(err != nil)
+}
+
+func TestStoreScanRowsKeysOnly(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	for i := 0; i < 3; i++ {
+		is.NoErr(store.Save(kvs.RootOwner{}, &Balloon{Color: "RED", Size: i}))
+	}
+
+	rowIDs := []uint32{}
+	is.NoErr(storage.ScanRows[Balloon](store, kvs.RootOwner{}, storage.RowScan{KeysOnly: true}, func(rowID uint32, row map[string]kvs.Entry) (bool, error) {
+		is.Equal(len(row), 2)
+		is.Equal(len(row["color"].Data), 0)
+		rowIDs = append(rowIDs, rowID)
+		return rowID < 1, nil
+	}))
+	is.Equal(rowIDs, []uint32{0, 1})
+}
+
+func TestStoreForEachStreamsRowsAndStopsEarly(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	for i := 0; i < 5; i++ {
+		is.NoErr(store.Save(kvs.RootOwner{}, &Balloon{Color: "RED", Size: i}))
+	}
+
+	sizes := []int{}
+	is.NoErr(storage.ForEach(store, kvs.RootOwner{}, func(b Balloon) error {
+		sizes = append(sizes, b.Size)
+		return nil
+	}))
+	is.Equal(sizes, []int{0, 1, 2, 3, 4})
+
+	sizes = sizes[:0]
+	is.NoErr(storage.ForEach(store, kvs.RootOwner{}, func(b Balloon) error {
+		sizes = append(sizes, b.Size)
+		if b.Size == 1 {
+			return storage.ErrStop
+		}
+		return nil
+	}))
+	is.Equal(sizes, []int{0, 1})
+
+	failure := errors.New("export failed")
+	is.Equal(storage.ForEach(store, kvs.RootOwner{}, func(b Balloon) error { return failure }), failure)
+}
+
+// BalloonV2 is Balloon after a field was added, rows saved as Balloon have
+// no entry for it.
+type BalloonV2 struct {
+	ID    uint32 `mdb:"ignore"`
+	Color string
+	Maker string
+	Size  int
+}
+
+func (b BalloonV2) TableName() string { return "balloons" }
+
+func TestStoreLoadAllWithEvaluator(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	is.NoErr(store.Save(kvs.RootOwner{}, &Balloon{Color: "RED", Size: 1}))
+	is.NoErr(store.Save(kvs.RootOwner{}, &Balloon{Color: "BLUE", Size: 2}))
+
+	blue, _, err := kvs.EncodeValue("BLUE", db.Codec())
+	is.NoErr(err)
+	notBlue := func(e kvs.Entry) bool { return !bytes.Equal(e.Data, blue) }
+	bs, err := storage.LoadAllWithEvaluator[Balloon](store, kvs.RootOwner{}, notBlue)
+	is.NoErr(err)
+	is.Equal(bs, []Balloon{{ID: 0, Color: "RED", Size: 1}})
+
+	failed := errors.New("failed")
+	_, err = storage.LoadAllWithErrorEvaluator[Balloon](store, kvs.RootOwner{}, func(e kvs.Entry) (bool, error) {
+		return false, failed
+	})
+	is.True(errors.Is(err, failed))
+}
+
+func TestStoreLoadToleratesAbsentColumns(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	is.NoErr(store.Save(kvs.RootOwner{}, &BalloonV2{Color: "RED", Maker: "ACME", Size: 1}))
+	is.NoErr(store.Save(kvs.RootOwner{}, &Balloon{Color: "GREEN", Size: 2}))
+	is.NoErr(store.Save(kvs.RootOwner{}, &BalloonV2{Color: "BLUE", Maker: "ACME", Size: 3}))
+
+	b := BalloonV2{Maker: "stale"}
+	is.NoErr(storage.Load(store, &b, kvs.RootOwner{}, 1))
+	is.Equal(b, BalloonV2{ID: 1, Color: "GREEN", Size: 2})
+
+	bs, err := storage.LoadAll[BalloonV2](store, kvs.RootOwner{})
+	is.NoErr(err)
+	is.Equal(bs, []BalloonV2{
+		{ID: 0, Color: "RED", Maker: "ACME", Size: 1},
+		{ID: 1, Color: "GREEN", Size: 2},
+		{ID: 2, Color: "BLUE", Maker: "ACME", Size: 3},
+	})
+
+	// rows which only lack the selected column are still returned
+	bs, err = storage.LoadAllColumns[BalloonV2](store, kvs.RootOwner{}, "maker")
+	is.NoErr(err)
+	is.Equal(len(bs), 3)
+
+	// only the projected columns are handed to the evaluator
+	seen := map[string]bool{}
+	_, _, err = storage.LoadProjectedPage[BalloonV2](store, kvs.RootOwner{}, storage.Projection{Columns: []string{"maker"}}, func(row map[string]kvs.Entry) (bool, error) {
+		for column := range row {
+			seen[column] = true
+		}
+		return true, nil
+	}, storage.Page{})
+	is.NoErr(err)
+	is.Equal(seen, map[string]bool{"maker": true})
+
+	err = storage.Load(store, &b, kvs.RootOwner{}, 3)
+	is.True(errors.Is(err, storage.ErrRowNotFound))
+}
+
+type Bakery struct {
+	ID   uint32 `mdb:"ignore"`
+	UUID kvs.UUID
+	Name string
+}
+
+func (b Bakery) TableName() string { return "bakeries" }
+
+type Pastry struct {
+	ID   uint32 `mdb:"ignore"`
+	UUID kvs.UUID
+	Type string
+}
+
+func (p Pastry) TableName() string { return "pastries" }
+
+type Candle struct {
+	ID  uint32 `mdb:"ignore"`
+	Lit bool
+}
+
+func (c Candle) TableName() string { return "candles" }
+
+func TestStoreLoadWithChildren(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	bakery := Bakery{UUID: uuid.New(), Name: "CORNER"}
+	carrot := Pastry{UUID: uuid.New(), Type: "CARROT"}
+	velvet := Pastry{UUID: uuid.New(), Type: "RED_VELVET"}
+	is.NoErr(store.Save(kvs.RootOwner{}, &bakery))
+	is.NoErr(store.Save(bakery.UUID, &carrot))
+	is.NoErr(store.Save(bakery.UUID, &velvet))
+	is.NoErr(store.Save(carrot.UUID, &Candle{Lit: true}))
+	is.NoErr(store.Save(carrot.UUID, &Candle{Lit: false}))
+	is.NoErr(store.Save(uuid.New(), &Candle{Lit: true}))
+
+	pastryKey := func(c Pastry) kvs.UUID { return c.UUID }
+	pastries, err := storage.LoadWithChildren[Pastry, Candle](store, bakery.UUID, pastryKey)
+	is.NoErr(err)
+	is.Equal(pastries, []storage.Group[Pastry, Candle]{
+		{Parent: carrot, Children: []Candle{{ID: 0, Lit: true}, {ID: 1, Lit: false}}},
+		{Parent: Pastry{ID: 1, UUID: velvet.UUID, Type: "RED_VELVET"}, Children: []Candle{}},
+	})
+
+	bakeries, err := storage.LoadWith(store, kvs.RootOwner{}, storage.WithChildren(
+		func(b Bakery) kvs.UUID { return b.UUID },
+		storage.WithChildren(pastryKey, storage.Rows[Candle]()),
+	))
+	is.NoErr(err)
+	is.Equal(len(bakeries), 1)
+	is.Equal(bakeries[0].Parent, bakery)
+	is.Equal(bakeries[0].Children, pastries)
+}
+
+func TestStoreDeleteCascadeRemovesOwnedRows(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	bakery := Bakery{UUID: uuid.New(), Name: "CORNER"}
+	carrot := Pastry{UUID: uuid.New(), Type: "CARROT"}
+	velvet := Pastry{UUID: uuid.New(), Type: "RED_VELVET"}
+	is.NoErr(store.Save(kvs.RootOwner{}, &bakery))
+	is.NoErr(store.Save(kvs.RootOwner{}, &Bakery{UUID: uuid.New(), Name: "HIGH_STREET"}))
+	is.NoErr(store.Save(bakery.UUID, &carrot))
+	is.NoErr(store.Save(bakery.UUID, &velvet))
+	is.NoErr(store.Save(carrot.UUID, &Candle{Lit: true}))
+	is.NoErr(store.Save(velvet.UUID, &Candle{Lit: false}))
+	is.NoErr(store.Save(carrot.UUID, &Pilot{Email: "amy@example.com", License: 7}))
+	other := uuid.New()
+	is.NoErr(store.Save(other, &Candle{Lit: true}))
+
+	report, err := store.DeleteCascade(kvs.RootOwner{}, &Bakery{}, bakery.ID)
+	is.NoErr(err)
+	is.Equal(report.Rows, map[string]int{"bakeries": 1, "pastries": 2, "candles": 2, "pilots": 1})
+
+	bakeries, err := storage.LoadAll[Bakery](store, kvs.RootOwner{})
+	is.NoErr(err)
+	is.Equal(len(bakeries), 1)
+	is.Equal(bakeries[0].Name, "HIGH_STREET")
+
+	candles, err := storage.LoadAll[Candle](store, other)
+	is.NoErr(err)
+	is.Equal(len(candles), 1)
+
+	// nothing but the leased row ID sequences and the short lived change
+	// markers are left behind
+	var dump bytes.Buffer
+	is.NoErr(db.DumpTo(&dump))
+	for _, line := range strings.Split(dump.String(), "\n") {
+		if strings.HasPrefix(line, "key=_chg.") {
+			continue
+		}
+		for _, id := range []kvs.UUID{bakery.UUID, carrot.UUID, velvet.UUID} {
+			if strings.Contains(line, id.String()) {
+				is.True(strings.HasPrefix(line, "key="+id.String()+"."))
+			}
+		}
+	}
+
+	// the global unique claim was released with the row holding it
+	is.NoErr(store.Save(uuid.New(), &Pilot{Email: "amy@example.com", License: 7}))
+
+	report, err = store.DeleteOwned(bakery.UUID)
+	is.NoErr(err)
+	is.Equal(report.Rows, map[string]int{})
+}
+
+type Kitchen struct {
+	ID   uint32 `mdb:"ignore"`
+	UUID kvs.UUID
+}
+
+func (k Kitchen) TableName() string { return "kitchens" }
+
+func (k Kitchen) SoftDelete() bool { return true }
+
+func TestStoreDeleteCascadeReachesChildrenOfSoftDeletedRows(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	kitchen := Kitchen{UUID: uuid.New()}
+	is.NoErr(store.Save(kvs.RootOwner{}, &kitchen))
+	is.NoErr(store.Save(kitchen.UUID, &Candle{Lit: true}))
+	is.NoErr(store.Save(kitchen.UUID, &Candle{Lit: false}))
+	is.NoErr(store.Delete(kvs.RootOwner{}, &Kitchen{}, kitchen.ID))
+
+	report, err := store.DeleteCascade(kvs.RootOwner{}, &Kitchen{}, kitchen.ID)
+	is.NoErr(err)
+	is.Equal(report.Rows, map[string]int{"kitchens": 1, "candles": 2})
+
+	candles, err := storage.LoadAll[Candle](store, kitchen.UUID)
+	is.NoErr(err)
+	is.Equal(len(candles), 0)
+}
+
+func TestStoreDeleteOwnedNeverHandsOutRowIDsAgain(t *testing.T) {
+	is := is.New(t)
+
+	bdb, err := badger.Open(badger.DefaultOptions("").WithLogger(nil).WithInMemory(true).WithNumVersionsToKeep(math.MaxInt32))
+	is.NoErr(err)
+	db, err := kvs.NewKVDB(bdb)
+	is.NoErr(err)
+	defer db.Close()
+
+	carrot := uuid.New()
+	store := storage.New(db, storage.WithRevisions())
+	is.NoErr(store.Save(carrot, &Candle{Lit: true}))
+	is.NoErr(store.Update(carrot, &Candle{Lit: false}, 0))
+	_, err = store.DeleteOwned(carrot)
+	is.NoErr(err)
+	store.Close()
+
+	store = storage.New(db, storage.WithRevisions())
+	defer store.Close()
+	candle := Candle{Lit: true}
+	is.NoErr(store.Save(carrot, &candle))
+	is.Equal(candle.ID, uint32(1))
+
+	history, err := storage.History[Candle](store, carrot, candle.ID)
+	is.NoErr(err)
+	is.Equal(len(history), 1)
+
+	// a row written under a removed row's ID starts a history of its own
+	is.NoErr(store.Update(carrot, &Candle{Lit: true}, 0))
+	history, err = storage.History[Candle](store, carrot, 0)
+	is.NoErr(err)
+	is.Equal(len(history), 1)
+	is.Equal(history[0].Row, Candle{ID: 0, Lit: true})
+}
+
+func TestStoreBackfillOwnershipCoversRowsSavedBeforeTheRegistry(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	ownershipVersion := func() uint64 {
+		var version uint64
+		is.NoErr(db.View(func(txn *badger.Txn) error {
+			item, err := txn.Get([]byte("_own.root.bakeries.name"))
+			if err != nil {
+				return err
+			}
+			version = item.Version()
+			return nil
+		}))
+		return version
+	}
+	is.NoErr(store.Save(kvs.RootOwner{}, &Bakery{UUID: uuid.New(), Name: "CORNER"}))
+	recorded := ownershipVersion()
+	is.NoErr(store.Save(kvs.RootOwner{}, &Bakery{UUID: uuid.New(), Name: "HIGH_STREET"}))
+	is.Equal(ownershipVersion(), recorded) // only the first save records the table
+
+	// candles written straight to the database, as saves before the
+	// registry existed left them
+	carrot := uuid.New()
+	entries, err := kvs.ConvertToEntries("candles", carrot, 0, Candle{Lit: true})
+	is.NoErr(err)
+	for _, e := range entries {
+		is.NoErr(kvs.Store(db, e))
+	}
+
+	report, err := store.DeleteOwned(carrot)
+	is.NoErr(err)
+	is.Equal(report.Rows, map[string]int{})
+
+	is.NoErr(storage.BackfillOwnership[Candle](store))
+	report, err = store.DeleteOwned(carrot)
+	is.NoErr(err)
+	is.Equal(report.Rows, map[string]int{"candles": 1})
+
+	candles, err := storage.LoadAll[Candle](store, carrot)
+	is.NoErr(err)
+	is.Equal(len(candles), 0)
+}
+
+func TestStoreTxCommitsOrDiscardsAsAUnit(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	carrot := Pastry{UUID: uuid.New(), Type: "CARROT"}
+	is.NoErr(store.Tx(func(tx *storage.Tx) error {
+		if err := tx.Save(kvs.RootOwner{}, &carrot); err != nil {
+			return err
+		}
+		if err := tx.Save(carrot.UUID, &Candle{Lit: true}); err != nil {
+			return err
+		}
+
+		// reads within the transaction see what it has written so far
+		candles, err := storage.LoadAll[Candle](tx.Store, carrot.UUID)
+		is.NoErr(err)
+		is.Equal(candles, []Candle{{ID: 0, Lit: true}})
+		return nil
+	}))
+
+	failed := errors.New("failed")
+	err = store.Tx(func(tx *storage.Tx) error {
+		if err := tx.Save(carrot.UUID, &Candle{Lit: false}); err != nil {
+			return err
+		}
+		if err := tx.Delete(kvs.RootOwner{}, &Pastry{}, carrot.ID); err != nil {
+			return err
+		}
+		return failed
+	})
+	is.True(errors.Is(err, failed))
+
+	pastries, err := storage.LoadAll[Pastry](store, kvs.RootOwner{})
+	is.NoErr(err)
+	is.Equal(pastries, []Pastry{carrot})
+
+	candles, err := storage.LoadAll[Candle](store, carrot.UUID)
+	is.NoErr(err)
+	is.Equal(candles, []Candle{{ID: 0, Lit: true}})
+}
+
+func TestStoreTxDiscardsAfterAFailedWriteIsIgnored(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	err = store.Tx(func(tx *storage.Tx) error {
+		if err := tx.Save(kvs.RootOwner{}, &Pilot{Email: "amy@example.com", License: 1}); err != nil {
+			return err
+		}
+		// the violation is handled, but the rejected save may have written part of the row
+		is.True(errors.Is(tx.Save(kvs.RootOwner{}, &Pilot{Email: "bob@example.com", License: 1}), storage.ErrUniqueViolation))
+		return nil
+	})
+	is.True(errors.Is(err, storage.ErrTxWriteFailed))
+	is.True(strings.Contains(err.Error(), storage.ErrUniqueViolation.Error()))
+
+	ps, err := storage.LoadAll[Pilot](store, kvs.RootOwner{})
+	is.NoErr(err)
+	is.Equal(len(ps), 0)
+
+	// nothing from the discarded transaction holds the license
+	is.NoErr(store.Save(kvs.RootOwner{}, &Pilot{Email: "bob@example.com", License: 1}))
+}
+
+func TestStoreTxRetriesOnConflict(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	is.NoErr(store.Save(kvs.RootOwner{}, &Balloon{Color: "RED", Size: 1}))
+
+	attempts := 0
+	is.NoErr(store.Tx(func(tx *storage.Tx) error {
+		attempts++
+
+		b := Balloon{}
+		if err := storage.Load(tx.Store, &b, kvs.RootOwner{}, 0); err != nil {
+			return err
+		}
+		if attempts == 1 {
+			// a write outside the transaction to a row it has read
+			is.NoErr(store.Update(kvs.RootOwner{}, &Balloon{Color: "RED", Size: 10}, 0))
+		}
+		b.Size++
+		return tx.Update(kvs.RootOwner{}, &b, 0)
+	}))
+	is.Equal(attempts, 2)
+
+	b := Balloon{}
+	is.NoErr(storage.Load(store, &b, kvs.RootOwner{}, 0))
+	is.Equal(b.Size, 11)
+}
+
+type Depot struct {
+	City   string
+	Street string
+}
+
+type Courier struct {
+	ID    uint32 `mdb:"ignore"`
+	Name  string
+	Depot Depot
+}
+
+func (c Courier) TableName() string { return "couriers" }
+
+// LegacyCourier stores its depot whole, as couriers were before nested
+// structs were flattened.
+type LegacyCourier struct {
+	ID    uint32 `mdb:"ignore"`
+	Name  string
+	Depot Depot `mdb:"noflatten"`
+}
+
+func (c LegacyCourier) TableName() string { return "couriers" }
+
+func TestStoreLoadsStructsSavedBeforeFlattening(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	is.NoErr(store.Save(kvs.RootOwner{}, &LegacyCourier{Name: "Amy", Depot: Depot{City: "York", Street: "Micklegate"}}))
+	is.NoErr(store.Save(kvs.RootOwner{}, &Courier{Name: "Brian", Depot: Depot{City: "Leeds"}}))
+
+	amy := Courier{}
+	is.NoErr(storage.Load(store, &amy, kvs.RootOwner{}, 0))
+	is.Equal(amy, Courier{ID: 0, Name: "Amy", Depot: Depot{City: "York", Street: "Micklegate"}})
+
+	cs, err := storage.LoadAll[Courier](store, kvs.RootOwner{})
+	is.NoErr(err)
+	is.Equal(cs, []Courier{amy, {ID: 1, Name: "Brian", Depot: Depot{City: "Leeds"}}})
+
+	cs, err = storage.LoadAllColumns[Courier](store, kvs.RootOwner{}, "depot.city")
+	is.NoErr(err)
+	is.Equal(cs[0].Depot.City, "York")
+
+	// writing the row in the flattened layout drops the whole struct entry
+	amy.Depot.Street = "Gillygate"
+	is.NoErr(store.Update(kvs.RootOwner{}, &amy, amy.ID))
+	is.True(kvs.Get(db, &kvs.Entry{TableName: "couriers", ColumnName: "depot", OwnerUUID: kvs.RootOwner{}, RowID: 0}) != nil)
+
+	loaded := Courier{}
+	is.NoErr(storage.Load(store, &loaded, kvs.RootOwner{}, 0))
+	is.Equal(loaded.Depot, Depot{City: "York", Street: "Gillygate"})
+}
+
+type Document struct {
+	ID      uint32 `mdb:"ignore"`
+	Title   string
+	Version uint32 `mdb:"version"`
+}
+
+func (d Document) TableName() string { return "documents" }
+
+func TestStoreUpdateRejectsStaleVersion(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	doc := Document{Title: "DRAFT", Version: 7}
+	is.NoErr(store.Save(kvs.RootOwner{}, &doc))
+	is.Equal(doc.Version, uint32(1))
+
+	first, second := Document{}, Document{}
+	is.NoErr(storage.Load(store, &first, kvs.RootOwner{}, doc.ID))
+	is.NoErr(storage.Load(store, &second, kvs.RootOwner{}, doc.ID))
+
+	first.Title = "FIRST"
+	is.NoErr(store.Update(kvs.RootOwner{}, &first, doc.ID))
+	is.Equal(first.Version, uint32(2))
+
+	second.Title = "SECOND"
+	err = store.Update(kvs.RootOwner{}, &second, doc.ID)
+	is.True(errors.Is(err, storage.ErrStaleVersion))
+	is.Equal(second.Version, uint32(1))
+
+	stored := Document{}
+	is.NoErr(storage.Load(store, &stored, kvs.RootOwner{}, doc.ID))
+	is.Equal(stored, Document{ID: doc.ID, Title: "FIRST", Version: 2})
+}
+
+func TestStoreTxPutsBackVersionsWhenNotCommitted(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	doc := Document{Title: "DRAFT"}
+	is.NoErr(store.Save(kvs.RootOwner{}, &doc))
+	is.NoErr(store.Save(kvs.RootOwner{}, &Balloon{Color: "RED", Size: 1}))
+
+	failed := errors.New("failed")
+	is.True(errors.Is(store.Tx(func(tx *storage.Tx) error {
+		doc.Title = "DISCARDED"
+		if err := tx.Update(kvs.RootOwner{}, &doc, doc.ID); err != nil {
+			return err
+		}
+		is.Equal(doc.Version, uint32(2))
+		return failed
+	}), failed))
+	is.Equal(doc.Version, uint32(1))
+
+	// a retried transaction starts from the version it was first given
+	attempts := 0
+	is.NoErr(store.Tx(func(tx *storage.Tx) error {
+		attempts++
+		is.Equal(doc.Version, uint32(1))
+		if err := storage.Load(tx.Store, &Balloon{}, kvs.RootOwner{}, 0); err != nil {
+			return err
+		}
+		if attempts == 1 {
+			is.NoErr(store.Update(kvs.RootOwner{}, &Balloon{Color: "RED", Size: 2}, 0))
+		}
+		doc.Title = "RETRIED"
+		return tx.Update(kvs.RootOwner{}, &doc, doc.ID)
+	}))
+	is.Equal(attempts, 2)
+	is.Equal(doc.Version, uint32(2))
+
+	doc.Title = "FINAL"
+	is.NoErr(store.Update(kvs.RootOwner{}, &doc, doc.ID))
+
+	stored := Document{}
+	is.NoErr(storage.Load(store, &stored, kvs.RootOwner{}, doc.ID))
+	is.Equal(stored, Document{ID: doc.ID, Title: "FINAL", Version: 3})
+}
+
+func TestStoreConcurrentVersionedUpdatesNeverOverwrite(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	is.NoErr(store.Save(kvs.RootOwner{}, &Document{Title: "COUNTER"}))
+
+	const workers, increments = 4, 10
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for done := 0; done < increments; {
+				doc := Document{}
+				if err := storage.Load(store, &doc, kvs.RootOwner{}, 0); err != nil {
+					errs <- err
+					return
+				}
+				err := store.Update(kvs.RootOwner{}, &doc, 0)
+				if errors.Is(err, storage.ErrStaleVersion) {
+					continue
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+				done++
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		is.NoErr(err)
+	}
+
+	doc := Document{}
+	is.NoErr(storage.Load(store, &doc, kvs.RootOwner{}, 0))
+	is.Equal(doc.Version, uint32(1+workers*increments))
+}
+
+func nextChange[T storage.Value](is *is.I, w *storage.Watcher[T]) storage.Change[T] {
+	is.Helper()
+	select {
+	case change, ok := <-w.C:
+		is.True(ok)
+		return change
+	case <-time.After(5 * time.Second):
+		is.Fail() // no change delivered
+	}
+	return storage.Change[T]{}
+}
+
+func TestStoreOnlyRecordsChangesAndRevisionsWhenAsked(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	is.NoErr(store.Save(kvs.RootOwner{}, &Balloon{Color: "RED", Size: 1}))
+	is.NoErr(store.Update(kvs.RootOwner{}, &Balloon{Color: "RED", Size: 2}, 0))
+	is.NoErr(store.Delete(kvs.RootOwner{}, &Balloon{}, 0))
+
+	var dump bytes.Buffer
+	is.NoErr(db.DumpTo(&dump))
+	is.True(!strings.Contains(dump.String(), "key=_chg."))
+	is.True(!strings.Contains(dump.String(), "key=_rev."))
+
+	_, err = storage.Watch[Balloon](context.Background(), store, kvs.RootOwner{})
+	is.True(errors.Is(err, storage.ErrChangesNotRecorded))
+}
+
+func TestStoreWatchDeliversOneChangePerRowWrite(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db, storage.WithChanges())
+	defer store.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	w, err := storage.Watch[Balloon](ctx, store, kvs.RootOwner{})
+	is.NoErr(err)
+
+	is.NoErr(store.Save(uuid.New(), &Balloon{Color: "PURPLE", Size: 9}))
+	is.NoErr(store.Save(kvs.RootOwner{}, &Balloon{Color: "RED", Size: 1}))
+	is.NoErr(store.Save(kvs.RootOwner{}, &Balloon{Color: "BLUE", Size: 2}))
+	is.NoErr(store.Update(kvs.RootOwner{}, &Balloon{Color: "GREEN", Size: 3}, 0))
+	is.NoErr(store.Delete(kvs.RootOwner{}, &Balloon{}, 1))
+
+	is.Equal(nextChange(is, w), storage.Change[Balloon]{Kind: storage.Created, RowID: 0, Row: Balloon{ID: 0, Color: "RED", Size: 1}})
+	is.Equal(nextChange(is, w), storage.Change[Balloon]{Kind: storage.Created, RowID: 1, Row: Balloon{ID: 1, Color: "BLUE", Size: 2}})
+	is.Equal(nextChange(is, w), storage.Change[Balloon]{Kind: storage.Updated, RowID: 0, Row: Balloon{ID: 0, Color: "GREEN", Size: 3}})
+	is.Equal(nextChange(is, w), storage.Change[Balloon]{Kind: storage.Deleted, RowID: 1, Row: Balloon{ID: 1}})
+
+	cancel()
+	for range w.C {
+	}
+	is.NoErr(w.Err())
+}
+
+func TestStoreWatchElementUpdates(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db, storage.WithChanges())
+	defer store.Close()
+
+	is.NoErr(store.Save(kvs.RootOwner{}, &Post{Title: "FIRST", Tags: []string{"a"}}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	w, err := storage.Watch[Post](ctx, store, kvs.RootOwner{})
+	is.NoErr(err)
+
+	is.NoErr(storage.AppendElements[Post](store, kvs.RootOwner{}, 0, "tags", "b"))
+
+	change := nextChange(is, w)
+	is.Equal(change.Kind, storage.Updated)
+	is.Equal(change.Row.Title, "FIRST")
+	is.Equal(change.Row.Tags, []string{"a", "b"})
+}
+
+type Session struct {
+	ID    uint32   `mdb:"ignore"`
+	Token string   `mdb:"unique"`
+	Tags  []string `mdb:"expand"`
+}
+
+func (s Session) TableName() string { return "sessions" }
+
+func (s Session) TTL() time.Duration { return time.Second }
+
+func TestStoreRowsExpireAsAWhole(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	is.NoErr(store.Save(kvs.RootOwner{}, &Session{Token: "abc", Tags: []string{"web"}}))
+	is.NoErr(store.SaveWithTTL(kvs.RootOwner{}, &Session{Token: "def"}, time.Hour))
+	is.NoErr(store.SaveWithTTL(kvs.RootOwner{}, &Balloon{Color: "RED", Size: 1}, time.Second))
+	is.NoErr(store.Save(kvs.RootOwner{}, &Balloon{Color: "BLUE", Size: 2}))
+
+	sessions, err := storage.LoadAll[Session](store, kvs.RootOwner{})
+	is.NoErr(err)
+	is.Equal(len(sessions), 2)
+
+	time.Sleep(2 * time.Second)
+
+	sessions, err = storage.LoadAll[Session](store, kvs.RootOwner{})
+	is.NoErr(err)
+	is.Equal(sessions, []Session{{ID: 1, Token: "def"}})
+
+	s := Session{}
+	err = storage.Load(store, &s, kvs.RootOwner{}, 0)
+	is.True(errors.Is(err, storage.ErrRowNotFound))
+
+	balloons, err := storage.LoadAll[Balloon](store, kvs.RootOwner{})
+	is.NoErr(err)
+	is.Equal(balloons, []Balloon{{ID: 1, Color: "BLUE", Size: 2}})
+
+	// the expired row's unique claim expired along with it
+	is.NoErr(store.Save(kvs.RootOwner{}, &Session{Token: "abc"}))
+	is.True(errors.Is(store.Save(kvs.RootOwner{}, &Session{Token: "def"}), storage.ErrUniqueViolation))
+}
+
+type Note struct {
+	ID    uint32 `mdb:"ignore"`
+	Title string `mdb:"unique"`
+}
+
+func (n Note) TableName() string { return "notes" }
+
+func (n Note) SoftDelete() bool { return true }
+
+func TestStoreSoftDeleteRestoreAndPurge(t *testing.T) {
+	is := is.New(t)
+
+	db, err := kvs.NewMemKVDB()
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db)
+	defer store.Close()
+
+	is.NoErr(store.Save(kvs.RootOwner{}, &Note{Title: "FIRST"}))
+	is.NoErr(store.Save(kvs.RootOwner{}, &Note{Title: "SECOND"}))
+	is.NoErr(store.Save(kvs.RootOwner{}, &Note{Title: "THIRD"}))
+
+	before := time.Now()
+	is.NoErr(store.Delete(kvs.RootOwner{}, &Note{}, 1))
+
+	notes, err := storage.LoadAll[Note](store, kvs.RootOwner{})
+	is.NoErr(err)
+	is.Equal(notes, []Note{{ID: 0, Title: "FIRST"}, {ID: 2, Title: "THIRD"}})
+
+	n := Note{}
+	is.True(errors.Is(storage.Load(store, &n, kvs.RootOwner{}, 1), storage.ErrRowNotFound))
+
+	deleted, err := storage.LoadDeleted[Note](store, kvs.RootOwner{})
+	is.NoErr(err)
+	is.Equal(len(deleted), 1)
+	is.Equal(deleted[0].Row, Note{ID: 1, Title: "SECOND"})
+	is.True(!deleted[0].DeletedAt.Before(before.Truncate(time.Second)))
+
+	// the deleted row keeps its unique value until it is purged
+	is.True(errors.Is(store.Save(kvs.RootOwner{}, &Note{Title: "SECOND"}), storage.ErrUniqueViolation))
+
+	is.NoErr(store.Restore(kvs.RootOwner{}, &Note{}, 1))
+	is.NoErr(storage.Load(store, &n, kvs.RootOwner{}, 1))
+	is.Equal(n, Note{ID: 1, Title: "SECOND"})
+	is.True(errors.Is(store.Restore(kvs.RootOwner{}, &Note{}, 1), storage.ErrRowNotFound))
+
+	is.NoErr(store.Delete(kvs.RootOwner{}, &Note{}, 1))
+	is.NoErr(store.Purge(kvs.RootOwner{}, &Note{}, 1))
+
+	deleted, err = storage.LoadDeleted[Note](store, kvs.RootOwner{})
+	is.NoErr(err)
+	is.Equal(len(deleted), 0)
+	is.True(errors.Is(store.Restore(kvs.RootOwner{}, &Note{}, 1), storage.ErrRowNotFound))
+	is.NoErr(store.Save(kvs.RootOwner{}, &Note{Title: "SECOND"}))
+}
+
+func TestStoreHistoryAndPointInTimeLoads(t *testing.T) {
+	is := is.New(t)
+
+	bdb, err := badger.Open(badger.DefaultOptions("").WithLogger(nil).WithInMemory(true).WithNumVersionsToKeep(math.MaxInt32))
+	is.NoErr(err)
+	db, err := kvs.NewKVDB(bdb)
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db, storage.WithRevisions())
+	defer store.Close()
+
+	before := time.Now()
+	is.NoErr(store.Save(kvs.RootOwner{}, &Post{Title: "FIRST", Tags: []string{"a"}}))
+	is.NoErr(store.Update(kvs.RootOwner{}, &Post{Title: "SECOND", Tags: []string{"a"}}, 0))
+	updated := time.Now()
+	is.NoErr(storage.AppendElements[Post](store, kvs.RootOwner{}, 0, "tags", "b"))
+	is.NoErr(store.Delete(kvs.RootOwner{}, &Post{}, 0))
+
+	history, err := storage.History[Post](store, kvs.RootOwner{}, 0)
+	is.NoErr(err)
+	is.Equal(len(history), 4)
+	is.Equal(history[0].Row, Post{Title: "FIRST", Tags: []string{"a"}})
+	is.Equal(history[1].Row, Post{Title: "SECOND", Tags: []string{"a"}})
+	is.Equal(history[2].Row, Post{Title: "SECOND", Tags: []string{"a", "b"}})
+	is.True(history[3].Deleted)
+	for i, revision := range history {
+		is.True(!revision.Time.Before(before))
+		if i > 0 {
+			is.True(revision.Version > history[i-1].Version)
+			is.True(!revision.Time.Before(history[i-1].Time))
+		}
+	}
+
+	p := Post{}
+	is.NoErr(storage.LoadAt(store, &p, kvs.RootOwner{}, 0, history[1].Version))
+	is.Equal(p, Post{Title: "SECOND", Tags: []string{"a"}})
+	is.True(errors.Is(storage.LoadAt(store, &p, kvs.RootOwner{}, 0, history[3].Version), storage.ErrRowNotFound))
+
+	p = Post{}
+	is.NoErr(storage.LoadAsOf(store, &p, kvs.RootOwner{}, 0, updated))
+	is.Equal(p, Post{Title: "SECOND", Tags: []string{"a"}})
+	is.True(errors.Is(storage.LoadAsOf(store, &p, kvs.RootOwner{}, 0, before), storage.ErrRowNotFound))
+	is.True(errors.Is(storage.LoadAsOf(store, &p, kvs.RootOwner{}, 0, time.Now()), storage.ErrRowNotFound))
+}
+
+func TestStoreHistoryOfAnExpiredRow(t *testing.T) {
+	is := is.New(t)
+
+	bdb, err := badger.Open(badger.DefaultOptions("").WithLogger(nil).WithInMemory(true).WithNumVersionsToKeep(math.MaxInt32))
+	is.NoErr(err)
+	db, err := kvs.NewKVDB(bdb)
+	is.NoErr(err)
+	defer db.Close()
+
+	store := storage.New(db, storage.WithRevisions())
+	defer store.Close()
+
+	is.NoErr(store.SaveWithTTL(kvs.RootOwner{}, &Balloon{Color: "RED", Size: 1}, time.Second))
+	is.NoErr(store.UpdateWithTTL(kvs.RootOwner{}, &Balloon{Color: "RED", Size: 2}, 0, time.Second))
+
+	time.Sleep(2 * time.Second)
+
+	history, err := storage.History[Balloon](store, kvs.RootOwner{}, 0)
+	is.NoErr(err)
+	is.Equal(len(history), 2)
+	// the first version expired after it was written over
+	is.True(!history[0].Deleted)
+	is.Equal(history[0].Row, Balloon{Color: "RED", Size: 1})
+	// nothing has written over the newest version, so its expiry removed the row
+	is.True(history[1].Deleted)
+
+	b := Balloon{}
+	is.NoErr(storage.LoadAt(store, &b, kvs.RootOwner{}, 0, history[0].Version))
+	is.Equal(b, Balloon{Color: "RED", Size: 1})
+	is.True(errors.Is(storage.LoadAt(store, &b, kvs.RootOwner{}, 0, history[1].Version), storage.ErrRowNotFound))
+	is.True(errors.Is(storage.LoadAsOf(store, &b, kvs.RootOwner{}, 0, time.Now()), storage.ErrRowNotFound))
+}
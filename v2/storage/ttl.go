@@ -0,0 +1,93 @@
+// Copyright (c) 2023 Adam Prakash Stringer
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted (subject to the limitations in the disclaimer
+// below) provided that the following conditions are met:
+//
+//     * Redistributions of source code must retain the above copyright notice,
+//     this list of conditions and the following disclaimer.
+//
+//     * Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+//     * Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from this
+//     software without specific prior written permission.
+//
+// NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+// THIS LICENSE. THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR
+// BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER
+// IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package storage
+
+import (
+	"time"
+
+	"github.com/tauraamui/kvs/v2"
+)
+
+// TTLValue can be implemented by a value to have every row of its table
+// expire the given duration after it was last written.
+type TTLValue interface {
+	Value
+	TTL() time.Duration
+}
+
+func ttlFor(v Value) time.Duration {
+	if tv, ok := v.(TTLValue); ok {
+		return tv.TTL()
+	}
+	return 0
+}
+
+// expiresAt resolves the unix time keys written now with ttl expire at, the
+// same way badger's Entry.WithTTL does.
+func expiresAt(ttl time.Duration) uint64 {
+	if ttl <= 0 {
+		return 0
+	}
+	return uint64(time.Now().Add(ttl).Unix())
+}
+
+// rowExpired reports whether the row the entries were read from has expired.
+// Every key of a row expires at the same time, but badger hides them one at a
+// time as it reads them, so a row is only whole if it still hasn't expired
+// once all of it has been read.
+func rowExpired(entries []kvs.Entry) bool {
+	now := uint64(time.Now().Unix())
+	for _, ent := range entries {
+		if ent.ExpiresAt != 0 && ent.ExpiresAt <= now {
+			return true
+		}
+	}
+	return false
+}
+
+// SaveWithTTL saves value as Save does, with every key of the new row
+// expiring after ttl, in place of the table's TTL if it has one.
+func (s Store) SaveWithTTL(owner kvs.UUID, value Value, ttl time.Duration) error {
+	rowID, err := nextRowID(s.db, owner, value.TableName(), s.pks)
+	if err != nil {
+		return err
+	}
+
+	return saveValue(s, owner, rowID, value, true, ttl)
+}
+
+// UpdateWithTTL updates the row as Update does, with every key of it expiring
+// after ttl from now. A plain Update of a row saved with a TTL, whose table
+// has none, leaves it without one.
+func (s Store) UpdateWithTTL(owner kvs.UUID, value Value, rowID uint32, ttl time.Duration) error {
+	return saveValue(s, owner, rowID, value, false, ttl)
+}
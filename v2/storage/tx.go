@@ -0,0 +1,209 @@
+// Copyright (c) 2023 Adam Prakash Stringer
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted (subject to the limitations in the disclaimer
+// below) provided that the following conditions are met:
+//
+//     * Redistributions of source code must retain the above copyright notice,
+//     this list of conditions and the following disclaimer.
+//
+//     * Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+//     * Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from this
+//     software without specific prior written permission.
+//
+// NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+// THIS LICENSE. THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR
+// BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER
+// IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package storage
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// maxTxAttempts is how many times Tx runs its function before giving up on
+// a transaction which keeps conflicting with others.
+const maxTxAttempts = 10
+
+// ErrTxWriteFailed is returned by Tx when its function returned nil after a
+// write within the transaction failed. A write which fails part way through
+// can leave some of its keys written, so the transaction is discarded rather
+// than committing them.
+var ErrTxWriteFailed = errors.New("write within transaction failed")
+
+// txState is what the writes of one attempt at a Tx leave for it to act on
+// once the attempt is over.
+type txState struct {
+	// failed holds the first error a write returned, which keeps the Tx from
+	// committing.
+	failed error
+	// undo puts back what writes changed in the values they were given, which
+	// is done if the attempt doesn't commit.
+	undo []func() error
+}
+
+// discard undoes the changes made to values, newest first.
+func (t *txState) discard() error {
+	for i := len(t.undo) - 1; i >= 0; i-- {
+		if err := t.undo[i](); err != nil {
+			return err
+		}
+	}
+	t.undo = nil
+	return nil
+}
+
+// Tx is a Store bound to a single transaction. Passing tx.Store to Load,
+// LoadAll, query.Run and the rest reads through the transaction, including
+// anything it has written so far.
+type Tx struct {
+	Store
+}
+
+// Tx runs fn within a single transaction, which is committed if fn returns
+// nil and discarded otherwise. If the commit conflicts with another
+// transaction fn is run again from the start, so it should not have effects
+// outside the transaction. Row IDs of values saved within fn are assigned
+// straight away and are not reused if the transaction is discarded, while
+// the version columns raised by saves are put back before fn is run again and
+// once the transaction is discarded. Any error from a write within fn discards the transaction, even if fn goes
+// on to return nil, in which case Tx returns ErrTxWriteFailed.
+// Calling Tx on a store bound to a Tx runs fn within that same transaction.
+func (s Store) Tx(fn func(tx *Tx) error) error {
+	if s.txn != nil {
+		return fn(&Tx{Store: s})
+	}
+
+	var err error
+	for attempt := 0; attempt < maxTxAttempts; attempt++ {
+		state := &txState{}
+		err = s.db.Update(func(txn *badger.Txn) error {
+			bound := s
+			bound.txn = txn
+			bound.tx = state
+			if err := fn(&Tx{Store: bound}); err != nil {
+				return err
+			}
+			if state.failed != nil {
+				return fmt.Errorf("%w: %v", ErrTxWriteFailed, state.failed)
+			}
+			return nil
+		})
+		if err == nil {
+			return nil
+		}
+		if err := state.discard(); err != nil {
+			return err
+		}
+		if !errors.Is(err, badger.ErrConflict) {
+			return err
+		}
+	}
+	return err
+}
+
+func (s Store) view(fn func(txn *badger.Txn) error) error {
+	if s.txn != nil {
+		return fn(s.txn)
+	}
+	return s.db.View(fn)
+}
+
+func (s Store) update(fn func(txn *badger.Txn) error) error {
+	if s.txn != nil {
+		err := fn(s.txn)
+		s.failTx(err)
+		return err
+	}
+	return s.db.Update(fn)
+}
+
+// failTx keeps the store's Tx from committing if err is set, as the write
+// which returned it may have been left half done.
+func (s Store) failTx(err error) {
+	if err != nil && s.tx != nil && s.tx.failed == nil {
+		s.tx.failed = err
+	}
+}
+
+// undoTx has fn run if the store's Tx doesn't commit.
+func (s Store) undoTx(fn func() error) {
+	if s.tx != nil {
+		s.tx.undo = append(s.tx.undo, fn)
+	}
+}
+
+// deleter is what cascading deletes remove keys through, a badger write batch
+// on its own or the store's transaction within a Tx.
+type deleter interface {
+	Delete(key []byte) error
+	SetEntry(e *badger.Entry) error
+	Flush() error
+	Cancel()
+}
+
+func (s Store) newDeleter() deleter {
+	if s.txn != nil {
+		return &txnDeleter{txn: s.txn, fail: s.failTx}
+	}
+	return s.db.NewWriteBatch()
+}
+
+// txnDeleter holds writes back until Flush, as keys are deleted while the
+// transaction is still iterating over them.
+type txnDeleter struct {
+	txn     *badger.Txn
+	keys    [][]byte
+	entries []*badger.Entry
+	fail    func(err error)
+}
+
+func (d *txnDeleter) Delete(key []byte) error {
+	d.keys = append(d.keys, key)
+	return nil
+}
+
+func (d *txnDeleter) SetEntry(e *badger.Entry) error {
+	d.entries = append(d.entries, e)
+	return nil
+}
+
+func (d *txnDeleter) Flush() error {
+	err := d.flush()
+	d.fail(err)
+	return err
+}
+
+func (d *txnDeleter) flush() error {
+	for _, key := range d.keys {
+		if err := d.txn.Delete(key); err != nil {
+			return err
+		}
+	}
+	for _, e := range d.entries {
+		if err := d.txn.SetEntry(e); err != nil {
+			return err
+		}
+	}
+	d.keys, d.entries = nil, nil
+	return nil
+}
+
+func (d *txnDeleter) Cancel() {}
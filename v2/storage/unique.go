@@ -0,0 +1,156 @@
+// Copyright (c) 2023 Adam Prakash Stringer
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted (subject to the limitations in the disclaimer
+// below) provided that the following conditions are met:
+//
+//     * Redistributions of source code must retain the above copyright notice,
+//     this list of conditions and the following disclaimer.
+//
+//     * Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+//     * Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from this
+//     software without specific prior written permission.
+//
+// NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+// THIS LICENSE. THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR
+// BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER
+// IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/tauraamui/kvs/v2"
+)
+
+var ErrUniqueViolation = errors.New("unique constraint violation")
+
+// Unique constraints are claimed with one key per distinct value, the value of
+// that key being the row which holds it. The scope is either the row's owner,
+// or for global constraints a fixed scope shared by every owner.
+//
+// _uniq.TABLE_NAME.<OWNERUUID|*>.COLUMN_NAME.<value>
+//
+// Because the claim is read and written inside the row's own transaction,
+// two writers racing for the same value conflict on commit instead of both
+// succeeding.
+const (
+	uniqueKeyPrefix   = "_uniq"
+	globalUniqueScope = "*"
+)
+
+func uniqueKey(tableName string, owner kvs.UUID, column kvs.Column, value []byte) []byte {
+	scope := ownerID(owner)
+	if column.UniqueGlobal {
+		scope = globalUniqueScope
+	}
+	return append([]byte(fmt.Sprintf("%s.%s.%s.%s.", uniqueKeyPrefix, tableName, scope, column.Name)), value...)
+}
+
+// encodeUniqueClaim identifies the row holding a unique value, the owner is
+// included as with global constraints rows of different owners share a scope.
+func encodeUniqueClaim(owner kvs.UUID, rowID uint32) []byte {
+	return append(binary.BigEndian.AppendUint32(nil, rowID), ownerID(owner)...)
+}
+
+func uniqueColumns(v any) []kvs.Column {
+	unique := []kvs.Column{}
+	for _, c := range kvs.Columns(v) {
+		if c.Unique {
+			unique = append(unique, c)
+		}
+	}
+	return unique
+}
+
+// claimedBy reads which row currently holds the unique key, if any.
+func claimedBy(txn *badger.Txn, key []byte) ([]byte, bool, error) {
+	item, err := txn.Get(key)
+	if err != nil {
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	claim, err := item.ValueCopy(nil)
+	return claim, true, err
+}
+
+func writeUniqueClaims(txn *badger.Txn, owner kvs.UUID, rowID uint32, v Value, expiresAt uint64) error {
+	claim := encodeUniqueClaim(owner, rowID)
+	for _, column := range uniqueColumns(v) {
+		current, err := kvs.ColumnValue(v, column.Name)
+		if err != nil {
+			return err
+		}
+		value, err := kvs.EncodeOrdered(current)
+		if err != nil {
+			return err
+		}
+
+		key := uniqueKey(v.TableName(), owner, column, value)
+		holder, found, err := claimedBy(txn, key)
+		if err != nil {
+			return err
+		}
+		if found && !bytes.Equal(holder, claim) {
+			return fmt.Errorf("%w: %s.%s already holds %v", ErrUniqueViolation, v.TableName(), column.Name, current)
+		}
+
+		if err := releaseUniqueClaim(txn, owner, rowID, v.TableName(), column, func(old []byte) bool {
+			return !bytes.Equal(old, value)
+		}); err != nil {
+			return err
+		}
+
+		e := badger.NewEntry(key, claim)
+		e.ExpiresAt = expiresAt
+		if err := txn.SetEntry(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func deleteUniqueClaims(txn *badger.Txn, owner kvs.UUID, rowID uint32, v Value) error {
+	for _, column := range uniqueColumns(v) {
+		if err := releaseUniqueClaim(txn, owner, rowID, v.TableName(), column, func([]byte) bool { return true }); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// releaseUniqueClaim removes the claim on the column's currently stored value,
+// as long as this row is the one holding it and release agrees.
+func releaseUniqueClaim(txn *badger.Txn, owner kvs.UUID, rowID uint32, tableName string, column kvs.Column, release func(old []byte) bool) error {
+	old, found, err := storedOrderedValue(txn, tableName, owner, rowID, column)
+	if err != nil || !found || !release(old) {
+		return err
+	}
+
+	key := uniqueKey(tableName, owner, column, old)
+	holder, found, err := claimedBy(txn, key)
+	if err != nil || !found || !bytes.Equal(holder, encodeUniqueClaim(owner, rowID)) {
+		return err
+	}
+	return txn.Delete(key)
+}
@@ -0,0 +1,110 @@
+// Copyright (c) 2023 Adam Prakash Stringer
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted (subject to the limitations in the disclaimer
+// below) provided that the following conditions are met:
+//
+//     * Redistributions of source code must retain the above copyright notice,
+//     this list of conditions and the following disclaimer.
+//
+//     * Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+//     * Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from this
+//     software without specific prior written permission.
+//
+// NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+// THIS LICENSE. THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR
+// BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER
+// IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/tauraamui/kvs/v2"
+)
+
+// ErrStaleVersion is returned when a value is written back with a version
+// other than its row's stored one, because the row was written in between.
+var ErrStaleVersion = errors.New("stale version")
+
+func versionColumn(v any) (kvs.Column, bool) {
+	for _, c := range kvs.Columns(v) {
+		if c.Version {
+			return c, true
+		}
+	}
+	return kvs.Column{}, false
+}
+
+// nextVersion moves v's version column on to the version after the row's
+// stored one, which for new rows is 1. Unless the row is new v must hold its
+// stored version, rows without a stored version count as version 0. It
+// returns the version v held before.
+func nextVersion(txn *badger.Txn, owner kvs.UUID, rowID uint32, v Value, column kvs.Column, create bool) (any, error) {
+	previous, err := kvs.ColumnValue(v, column.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	var stored uint64
+	if !create {
+		if stored, err = storedVersion(txn, v.TableName(), owner, rowID, column); err != nil {
+			return nil, err
+		}
+		if held := versionNumber(reflect.ValueOf(previous)); held != stored {
+			return nil, fmt.Errorf("%w: row %d of %s is at version %d, not %d", ErrStaleVersion, rowID, v.TableName(), stored, held)
+		}
+	}
+
+	next := reflect.ValueOf(stored + 1).Convert(column.Type).Interface()
+	if err := kvs.SetColumnValue(v, column.Name, next); err != nil {
+		return nil, err
+	}
+	return previous, nil
+}
+
+func storedVersion(txn *badger.Txn, tableName string, owner kvs.UUID, rowID uint32, column kvs.Column) (uint64, error) {
+	ent := kvs.Entry{TableName: tableName, ColumnName: column.Name, OwnerUUID: owner, RowID: rowID}
+	item, err := txn.Get(ent.Key())
+	if err != nil {
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	if err := loadItemDataIntoEntry(&ent, item.Value); err != nil {
+		return 0, err
+	}
+	stored, err := kvs.DecodeBytes(ent.Data, kvs.Encoding(item.UserMeta()), column.Type)
+	if err != nil {
+		return 0, err
+	}
+	return versionNumber(reflect.ValueOf(stored)), nil
+}
+
+func versionNumber(v reflect.Value) uint64 {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return uint64(v.Int())
+	default:
+		return v.Uint()
+	}
+}
@@ -0,0 +1,314 @@
+// Copyright (c) 2023 Adam Prakash Stringer
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted (subject to the limitations in the disclaimer
+// below) provided that the following conditions are met:
+//
+//     * Redistributions of source code must retain the above copyright notice,
+//     this list of conditions and the following disclaimer.
+//
+//     * Redistributions in binary form must reproduce the above copyright
+//     notice, this list of conditions and the following disclaimer in the
+//     documentation and/or other materials provided with the distribution.
+//
+//     * Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from this
+//     software without specific prior written permission.
+//
+// NO EXPRESS OR IMPLIED LICENSES TO ANY PARTY'S PATENT RIGHTS ARE GRANTED BY
+// THIS LICENSE. THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND
+// CONTRIBUTORS "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A
+// PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL,
+// EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO,
+// PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR
+// BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER
+// IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/dgraph-io/badger/v3/pb"
+	"github.com/google/uuid"
+	"github.com/tauraamui/kvs/v2"
+)
+
+// Writes of a row through a store created WithChanges also write a short
+// lived marker recording what kind of change it was, as a subscription can't
+// tell a deleted key from one set to an empty value. The marker shares the
+// write's commit, which is what groups the column writes of one row into a
+// single change.
+//
+// _chg.TABLE_NAME.OWNERUUID.ROW_ID
+const changeKeyPrefix = "_chg"
+
+// changeTTL is how long a change marker outlives its commit, it only has to be
+// stored for as long as subscribers take to be handed it.
+const changeTTL = time.Minute
+
+// watchKeyPrefix is where Watch writes the key it waits for to know that its
+// subscription is in place.
+const watchKeyPrefix = "_watch"
+
+// watchReadyInterval is how often Watch writes its ready key again until its
+// subscription sees it, a write made before the subscription has registered
+// is never delivered to it.
+const watchReadyInterval = 10 * time.Millisecond
+
+// ChangeKind is the kind of write a Change was made by.
+type ChangeKind byte
+
+const (
+	Created ChangeKind = iota + 1
+	Updated
+	Deleted
+)
+
+func (k ChangeKind) String() string {
+	switch k {
+	case Created:
+		return "created"
+	case Updated:
+		return "updated"
+	case Deleted:
+		return "deleted"
+	default:
+		return "unknown"
+	}
+}
+
+// Change is a single write of a row.
+type Change[T Value] struct {
+	Kind  ChangeKind
+	RowID uint32
+	// Row holds the columns the write stored, every other column, such as
+	// the elements of expanded columns, is read as it is stored when the
+	// change is handled. Only the ID of a deleted row is set.
+	Row T
+}
+
+func changePrefix(tableName string, owner kvs.UUID) []byte {
+	return []byte(fmt.Sprintf("%s.%s.%s.", changeKeyPrefix, tableName, ownerID(owner)))
+}
+
+func changeEntry(tableName string, owner kvs.UUID, rowID uint32, kind ChangeKind) *badger.Entry {
+	key := strconv.AppendUint(changePrefix(tableName, owner), uint64(rowID), 10)
+	return badger.NewEntry(key, []byte{byte(kind)}).WithTTL(changeTTL)
+}
+
+// writeChange records the change unless the store doesn't record changes.
+func (s Store) writeChange(txn *badger.Txn, tableName string, owner kvs.UUID, rowID uint32, kind ChangeKind) error {
+	if !s.changes {
+		return nil
+	}
+	return txn.SetEntry(changeEntry(tableName, owner, rowID, kind))
+}
+
+// ErrChangesNotRecorded is returned by Watch for stores created without
+// WithChanges.
+var ErrChangesNotRecorded = errors.New("store doesn't record changes")
+
+// Watcher delivers the changes made to the rows of a table and owner.
+type Watcher[T Value] struct {
+	// C is handed each change in commit order, it is closed once watching
+	// stops.
+	C   <-chan Change[T]
+	err error
+}
+
+// Err reports why watching stopped once C is closed, it is nil if the
+// context was done.
+func (w *Watcher[T]) Err() error {
+	return w.err
+}
+
+// Watch watches owner's rows of T until ctx is done. It returns once the
+// subscription is in place, so every write committed after it returns is
+// delivered. Only writes made through stores created WithChanges are
+// delivered, which s has to be one of.
+func Watch[T Value](ctx context.Context, s Store, owner kvs.UUID) (*Watcher[T], error) {
+	if !s.changes {
+		return nil, ErrChangesNotRecorded
+	}
+
+	tableName := (*new(T)).TableName()
+	blankEntries := kvs.ConvertToBlankEntries(tableName, owner, 0, *new(T))
+
+	ready := []byte(fmt.Sprintf("%s.%s", watchKeyPrefix, uuid.New()))
+	matches := []pb.Match{{Prefix: changePrefix(tableName, owner)}, {Prefix: ready}}
+	for _, ent := range blankEntries {
+		matches = append(matches, pb.Match{Prefix: append(ent.PrefixKey(), '.')})
+	}
+
+	c := make(chan Change[T])
+	w := &Watcher[T]{C: c}
+	subscribed := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer close(c)
+		isSubscribed := false
+		err := s.db.Subscribe(ctx, func(list *badger.KVList) error {
+			changes, isReady, err := groupChanges[T](s, owner, blankEntries, list.Kv, ready)
+			if err != nil {
+				return err
+			}
+			if isReady && !isSubscribed {
+				isSubscribed = true
+				close(subscribed)
+			}
+			for _, change := range changes {
+				select {
+				case c <- change:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+			return nil
+		}, matches)
+		if !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
+			w.err = err
+		}
+	}()
+
+	ticker := time.NewTicker(watchReadyInterval)
+	defer ticker.Stop()
+	for {
+		if err := s.db.Update(func(txn *badger.Txn) error {
+			return txn.SetEntry(badger.NewEntry(ready, nil).WithTTL(changeTTL))
+		}); err != nil {
+			return nil, err
+		}
+		select {
+		case <-subscribed:
+			return w, nil
+		case <-done:
+			if w.err != nil {
+				return nil, w.err
+			}
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// groupChanges turns the writes of a batch into one change per row written
+// by each commit, reporting whether the batch held the ready key.
+func groupChanges[T Value](s Store, owner kvs.UUID, blankEntries []kvs.Entry, kvList []*pb.KV, ready []byte) ([]Change[T], bool, error) {
+	type commitRow struct {
+		version uint64
+		rowID   uint32
+	}
+
+	isReady := false
+	order := []commitRow{}
+	kinds := map[commitRow]ChangeKind{}
+	written := map[commitRow][]kvs.Entry{}
+	marker := changePrefix((*new(T)).TableName(), owner)
+	for _, kv := range kvList {
+		if string(kv.Key) == string(ready) {
+			isReady = true
+			continue
+		}
+
+		if len(kv.Key) > len(marker) && string(kv.Key[:len(marker)]) == string(marker) {
+			rowID, err := strconv.ParseUint(string(kv.Key[len(marker):]), 10, 32)
+			if err != nil || len(kv.Value) != 1 {
+				continue
+			}
+			cr := commitRow{version: kv.Version, rowID: uint32(rowID)}
+			if _, seen := kinds[cr]; !seen {
+				order = append(order, cr)
+			}
+			kinds[cr] = ChangeKind(kv.Value[0])
+			continue
+		}
+
+		for _, ent := range blankEntries {
+			prefix := append(ent.PrefixKey(), '.')
+			if len(kv.Key) <= len(prefix) || string(kv.Key[:len(prefix)]) != string(prefix) {
+				continue
+			}
+			rowID, err := strconv.ParseUint(string(kv.Key[len(prefix):]), 10, 32)
+			if err != nil {
+				break
+			}
+			ent.RowID = uint32(rowID)
+			ent.Data = kv.Value
+			if len(kv.Meta) > 0 {
+				ent.Meta = kv.Meta[0]
+			}
+			cr := commitRow{version: kv.Version, rowID: ent.RowID}
+			written[cr] = append(written[cr], ent)
+			break
+		}
+	}
+
+	changes := make([]Change[T], 0, len(order))
+	err := s.view(func(txn *badger.Txn) error {
+		for _, cr := range order {
+			change := Change[T]{Kind: kinds[cr], RowID: cr.rowID}
+			if change.Kind != Deleted {
+				row, err := assembleRow[T](txn, owner, cr.rowID, blankEntries, written[cr])
+				if err != nil {
+					return err
+				}
+				change.Row = row
+			}
+			if err := kvs.LoadID(&change.Row, cr.rowID); err != nil {
+				return err
+			}
+			changes = append(changes, change)
+		}
+		return nil
+	})
+	return changes, isReady, err
+}
+
+// assembleRow builds a row from the entries a write stored, reading the
+// columns it didn't write as they are currently stored.
+func assembleRow[T Value](txn *badger.Txn, owner kvs.UUID, rowID uint32, blankEntries []kvs.Entry, written []kvs.Entry) (T, error) {
+	row := *new(T)
+	fromWrite := map[string]bool{}
+	for _, ent := range written {
+		fromWrite[ent.ColumnName] = true
+	}
+
+	unwritten := []kvs.Entry{}
+	for _, ent := range blankEntries {
+		if !fromWrite[ent.ColumnName] {
+			unwritten = append(unwritten, ent)
+		}
+	}
+	if len(unwritten) > 0 {
+		_, stored, _, err := newListedRows(txn, []uint32{rowID}, unwritten, nil, nil, liveRowsOf(*new(T))).next()
+		if err != nil {
+			return row, err
+		}
+		written = append(stored, written...)
+	}
+
+	present := map[string]bool{}
+	for _, ent := range written {
+		present[ent.ColumnName] = true
+		if err := kvs.LoadEntry(&row, ent); err != nil {
+			return row, err
+		}
+	}
+	legacy := kvs.ConvertToLegacyEntries(row.TableName(), owner, rowID, row)
+	if err := loadLegacyStructs(txn, legacy, rowID, &row, present, nil); err != nil {
+		return row, err
+	}
+	return row, loadElements(txn, row.TableName(), owner, rowID, &row, nil)
+}